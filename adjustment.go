@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// The adjustments an edit recipe can be made of
+const (
+	adjustBrightness = "brightness"
+	adjustContrast   = "contrast"
+	adjustGamma      = "gamma"
+	adjustSaturation = "saturation"
+	adjustSharpen    = "sharpen"
+	adjustBlur       = "blur"
+	adjustGrayscale  = "grayscale"
+	adjustInvert     = "invert"
+	adjustRotate     = "rotate"
+	adjustCrop       = "crop"
+)
+
+const maxRecipeLength = 20
+
+// The values each adjustment accepts. Sharpen and blur are capped as their
+// cost grows with the value.
+var adjustmentRanges = map[string]struct {
+	Min, Max float64
+}{
+	adjustBrightness: {-100, 100},
+	adjustContrast:   {-100, 100},
+	adjustGamma:      {0.1, 10},
+	adjustSaturation: {-100, 100},
+	adjustSharpen:    {0.1, 10},
+	adjustBlur:       {0.1, 20},
+	adjustGrayscale:  {0, 0},
+	adjustInvert:     {0, 0},
+	adjustRotate:     {90, 270},
+	adjustCrop:       {0, 0},
+}
+
+// AdjustmentOps lists the adjustments in the order the editor offers them.
+var AdjustmentOps = []string{
+	adjustBrightness,
+	adjustContrast,
+	adjustGamma,
+	adjustSaturation,
+	adjustSharpen,
+	adjustBlur,
+	adjustGrayscale,
+	adjustInvert,
+	adjustRotate,
+	adjustCrop,
+}
+
+// Adjustment is one step of an edit recipe. Value is a percentage for
+// brightness, contrast and saturation, a sigma for sharpen and blur, and
+// degrees counter-clockwise for rotate.
+type Adjustment struct {
+	Op    string  `bson:"op"`
+	Value float64 `bson:"value,omitempty"`
+	// The area a crop keeps, in pixels of the image as the steps before
+	// left it
+	X      int `bson:"x,omitempty"`
+	Y      int `bson:"y,omitempty"`
+	Width  int `bson:"width,omitempty"`
+	Height int `bson:"height,omitempty"`
+}
+
+// Recipe is the ordered list of adjustments made to an image. The original
+// is never changed, renditions are made from the original with the recipe
+// applied.
+type Recipe []Adjustment
+
+func (adjustment *Adjustment) Validate() error {
+	limits, ok := adjustmentRanges[adjustment.Op]
+	if !ok {
+		return errInvalidAdjustment
+	}
+	switch adjustment.Op {
+	case adjustRotate:
+		if adjustment.Value != 90 && adjustment.Value != 180 && adjustment.Value != 270 {
+			return errInvalidAdjustment
+		}
+	case adjustCrop:
+		if adjustment.X < 0 || adjustment.Y < 0 || adjustment.Width <= 0 || adjustment.Height <= 0 {
+			return errInvalidAdjustment
+		}
+	default:
+		if adjustment.Value < limits.Min || adjustment.Value > limits.Max {
+			return errInvalidAdjustment
+		}
+	}
+	return nil
+}
+
+func (recipe Recipe) Validate() error {
+	if len(recipe) > maxRecipeLength {
+		return errTooManyAdjustments
+	}
+	for i := range recipe {
+		err := recipe[i].Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String describes the adjustment for the editor, as in "Brightness +20".
+func (adjustment Adjustment) String() string {
+	switch adjustment.Op {
+	case adjustBrightness, adjustContrast, adjustSaturation:
+		return fmt.Sprintf("%s %+g%%", adjustmentName(adjustment.Op), adjustment.Value)
+	case adjustGamma, adjustSharpen, adjustBlur:
+		return fmt.Sprintf("%s %g", adjustmentName(adjustment.Op), adjustment.Value)
+	case adjustRotate:
+		return fmt.Sprintf("Rotate %g°", adjustment.Value)
+	case adjustCrop:
+		return fmt.Sprintf("Crop %dx%d at %d,%d", adjustment.Width, adjustment.Height, adjustment.X, adjustment.Y)
+	}
+	return adjustmentName(adjustment.Op)
+}
+
+func adjustmentName(op string) string {
+	if op == "" {
+		return ""
+	}
+	return string(op[0]-'a'+'A') + op[1:]
+}
+
+// Apply makes every adjustment of the recipe to img, in order.
+func (recipe Recipe) Apply(img image.Image) (image.Image, error) {
+	for _, adjustment := range recipe {
+		switch adjustment.Op {
+		case adjustBrightness:
+			img = imaging.AdjustBrightness(img, adjustment.Value)
+		case adjustContrast:
+			img = imaging.AdjustContrast(img, adjustment.Value)
+		case adjustGamma:
+			img = imaging.AdjustGamma(img, adjustment.Value)
+		case adjustSaturation:
+			img = adjustImageSaturation(img, adjustment.Value)
+		case adjustSharpen:
+			img = imaging.Sharpen(img, adjustment.Value)
+		case adjustBlur:
+			img = imaging.Blur(img, adjustment.Value)
+		case adjustGrayscale:
+			img = imaging.Grayscale(img)
+		case adjustInvert:
+			img = imaging.Invert(img)
+		case adjustRotate:
+			switch adjustment.Value {
+			case 90:
+				img = imaging.Rotate90(img)
+			case 180:
+				img = imaging.Rotate180(img)
+			case 270:
+				img = imaging.Rotate270(img)
+			}
+		case adjustCrop:
+			bounds := img.Bounds()
+			rect := image.Rect(adjustment.X, adjustment.Y, adjustment.X+adjustment.Width, adjustment.Y+adjustment.Height)
+			rect = rect.Add(bounds.Min).Intersect(bounds)
+			if rect.Empty() {
+				return nil, errCropOutsideImage
+			}
+			img = imaging.Crop(img, rect)
+		default:
+			return nil, errInvalidAdjustment
+		}
+	}
+	return img, nil
+}
+
+// adjustImageSaturation moves each pixel towards or away from its own grey
+// by percentage, from -100 for grey to 100 for twice as colourful. The
+// vendored imaging has no saturation of its own.
+func adjustImageSaturation(img image.Image, percentage float64) *image.NRGBA {
+	factor := 1 + percentage/100
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		grey := 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+		saturate := func(v uint8) uint8 {
+			return uint8(math.Max(0, math.Min(255, grey+(float64(v)-grey)*factor+0.5)))
+		}
+		return color.NRGBA{saturate(c.R), saturate(c.G), saturate(c.B), c.A}
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+)
+
+// Animation is an animated GIF with its frames composited into whole
+// pictures. Frames of a GIF only cover the part that changed and rely on
+// the disposal of the frame before, so they can't be resized on their own.
+type Animation struct {
+	Frames    []*image.NRGBA
+	Palettes  []color.Palette // the palette of each frame in the original
+	Delays    []int           // in 100ths of a second
+	LoopCount int
+}
+
+// DecodeAnimation reads every frame of a GIF. It returns nil if the GIF
+// isn't animated, or has more frames than may be kept in memory.
+func DecodeAnimation(r io.Reader) (*Animation, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Every frame is kept whole, so an animation may take no more memory
+	// than the largest still allowed. Longer ones are shown still, which is
+	// found out before any frame is decoded.
+	frames, ok := scanGIFFrames(data, int64(config.UploadMaxPixels))
+	if !ok || frames < 2 {
+		return nil, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+
+	anim := &Animation{
+		LoopCount: g.LoopCount,
+	}
+	// The background shows through as transparent, which is what browsers do
+	canvas := image.NewNRGBA(bounds)
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		anim.Frames = append(anim.Frames, cloneNRGBA(canvas))
+		anim.Palettes = append(anim.Palettes, frame.Palette)
+		anim.Delays = append(anim.Delays, g.Delay[i])
+
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+	return anim, nil
+}
+
+// scanGIFFrames walks the blocks of a GIF without decoding them, and counts
+// its frames. It gives up, returning false, once the frames would take more
+// than maxPixels pixels kept whole, or if data isn't a GIF it can walk.
+func scanGIFFrames(data []byte, maxPixels int64) (int, bool) {
+	if len(data) < 13 || string(data[:3]) != "GIF" {
+		return 0, false
+	}
+	canvas := int64(uint16(data[6])|uint16(data[7])<<8) * int64(uint16(data[8])|uint16(data[9])<<8)
+	pos := 13 + colorTableSize(data[10])
+
+	frames := 0
+	pixels := int64(0)
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension, a label and sub-blocks
+			pos += 2
+		case 0x2c: // image descriptor
+			if pos+10 > len(data) {
+				return 0, false
+			}
+			area := int64(uint16(data[pos+5])|uint16(data[pos+6])<<8) * int64(uint16(data[pos+7])|uint16(data[pos+8])<<8)
+			if area < canvas {
+				area = canvas
+			}
+			frames++
+			pixels += area
+			if pixels > maxPixels {
+				return frames, false
+			}
+			// The color table, the LZW code size, then the sub-blocks of
+			// the image data
+			pos += 10 + colorTableSize(data[pos+9]) + 1
+		case 0x3b: // trailer
+			return frames, true
+		default:
+			return 0, false
+		}
+		for pos < len(data) && data[pos] != 0 {
+			pos += int(data[pos]) + 1
+		}
+		pos++
+	}
+	// Cut off before the trailer, which the decoder allows
+	return frames, true
+}
+
+// colorTableSize is the length of the color table the packed fields of a
+// GIF descriptor announce.
+func colorTableSize(fields byte) int {
+	if fields&0x80 == 0 {
+		return 0
+	}
+	return 3 << (uint(fields&0x07) + 1)
+}
+
+func cloneNRGBA(src *image.NRGBA) *image.NRGBA {
+	dst := image.NewNRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// Poster is the still picture shown where animation isn't wanted.
+func (anim *Animation) Poster() image.Image {
+	return anim.Frames[0]
+}
+
+// GenerateAnimated resizes every frame of anim, the original stored at
+// location, and stores the result as an animated GIF. It returns the name
+// of the new blob.
+func (rendition *Rendition) GenerateAnimated(anim *Animation, focus FocalPoint, location string) (string, error) {
+	out := &gif.GIF{
+		LoopCount: anim.LoopCount,
+	}
+	for i, frame := range anim.Frames {
+		resized := rendition.Resize(frame, focus)
+		paletted := image.NewPaletted(resized.Bounds(), framePalette(anim.Palettes[i], resized))
+		draw.Draw(paletted, paletted.Bounds(), resized, resized.Bounds().Min, draw.Src)
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, anim.Delays[i])
+		// Every frame is whole, so nothing of the one before may show
+		// through its transparent parts
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+	if len(out.Image) > 0 {
+		bounds := out.Image[0].Bounds()
+		out.Config = image.Config{
+			ColorModel: out.Image[0].Palette,
+			Width:      bounds.Dx(),
+			Height:     bounds.Dy(),
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err := gif.EncodeAll(buf, out)
+	if err != nil {
+		return "", err
+	}
+
+	name := rendition.BlobName(location, "gif")
+	_, err = globalBlobStore.Put(name, buf)
+	return name, err
+}
+
+// GeneratePoster stores a still of the rendition, made from the first frame
+// of an animation, as a PNG. It returns the name of the new blob.
+func (rendition *Rendition) GeneratePoster(anim *Animation, focus FocalPoint, location string) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	err := encodeImage(buf, rendition.Resize(anim.Poster(), focus), "png", 0)
+	if err != nil {
+		return "", err
+	}
+
+	name := rendition.BlobName(location, "png")
+	_, err = globalBlobStore.Put(name, buf)
+	return name, err
+}
+
+// framePalette returns the palette to draw a resized frame with. That is the
+// palette of the original frame, with a transparent color added if the frame
+// needs one and there is room.
+func framePalette(original color.Palette, frame image.Image) color.Palette {
+	palette := append(color.Palette{}, original...)
+	if len(palette) == 0 {
+		palette = append(palette, color.Black, color.White)
+	}
+
+	opaque, ok := frame.(interface {
+		Opaque() bool
+	})
+	if !ok || opaque.Opaque() || len(palette) >= 256 {
+		return palette
+	}
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return palette
+		}
+	}
+	return append(palette, color.Transparent)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+)
+
+// testGIF encodes a GIF with a canvas of width by height and one frame of
+// frameWidth by frameHeight per delay.
+func testGIF(t *testing.T, width, height, frameWidth, frameHeight int, delays ...int) []byte {
+	anim := &gif.GIF{
+		Config: image.Config{Width: width, Height: height, ColorModel: color.Palette(palette.Plan9)},
+	}
+	for _, delay := range delays {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, frameWidth, frameHeight), palette.Plan9))
+		anim.Delay = append(anim.Delay, delay)
+	}
+	encoded := bytes.NewBuffer(nil)
+	err := gif.EncodeAll(encoded, anim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded.Bytes()
+}
+
+func TestScanGIFFrames(t *testing.T) {
+	still := testGIF(t, 10, 10, 10, 10, 0)
+	animated := testGIF(t, 10, 10, 10, 10, 10, 10, 10)
+	// Frames smaller than the canvas are kept at its size
+	small := testGIF(t, 100, 100, 10, 10, 10, 10, 10)
+	// A 1x1 logical screen without a color table, for GIFs made by hand
+	header := "GIF89a\x01\x00\x01\x00\x00\x00\x00"
+
+	tests := []struct {
+		name      string
+		data      []byte
+		maxPixels int64
+		frames    int
+		ok        bool
+	}{
+		{"still", still, 1000, 1, true},
+		{"animated", animated, 1000, 3, true},
+		{"just within the limit", animated, 300, 3, true},
+		{"over the limit", animated, 299, 3, false},
+		{"small frames on a large canvas", small, 25000, 3, false},
+		{"small frames within the limit", small, 30000, 3, true},
+		{"cut off before the trailer", animated[:len(animated)-1], 1000, 3, true},
+		{"not a GIF", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), 1000, 0, false},
+		{"too short", animated[:12], 1000, 0, false},
+		{"unknown block", append(still[:len(still)-1:len(still)-1], 0x99), 1000, 0, false},
+		{"image descriptor cut off", []byte(header + "\x2c\x00\x00\x00"), 1000, 0, false},
+		{"extensions only", []byte(header + "\x21\xfe\x02hi\x00\x3b"), 1000, 0, true},
+	}
+	for _, test := range tests {
+		frames, ok := scanGIFFrames(test.data, test.maxPixels)
+		if frames != test.frames || ok != test.ok {
+			t.Errorf("%s: got %d frames, %v, want %d, %v", test.name, frames, ok, test.frames, test.ok)
+		}
+	}
+}
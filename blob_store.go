@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+var globalBlobStore BlobStore
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore holds the bytes of images and their renditions. Blobs are
+// addressed by slash separated names such as "thumbnail/img_123.jpg", which
+// are also the paths they're served under below /im/.
+type BlobStore interface {
+	// Put stores everything read from r under name, replacing any blob
+	// already there, and returns the number of bytes stored.
+	Put(name string, r io.Reader) (int64, error)
+	// Get opens a blob for reading. It returns errBlobNotFound if there's no
+	// blob with that name.
+	Get(name string) (BlobReader, *BlobInfo, error)
+	// Delete removes a blob. Deleting a missing blob is not an error.
+	Delete(name string) error
+	// Stat describes a blob without opening it. It returns errBlobNotFound
+	// if there's no blob with that name.
+	Stat(name string) (*BlobInfo, error)
+}
+
+// BlobReader streams the contents of a blob. It can seek, so blobs can be
+// served with http.ServeContent, which takes care of range requests.
+type BlobReader interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// BlobURLer is implemented by blob stores that can hand out a URL from which
+// a browser can fetch a blob directly.
+type BlobURLer interface {
+	URL(name string, expires time.Duration) (string, error)
+}
+
+type BlobInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+func InitBlobStore() {
+	var store BlobStore
+	var err error
+
+	switch config.BlobStore {
+	case "local":
+		store, err = NewLocalBlobStore(config.BlobRoot)
+	case "gridfs":
+		store, err = NewGridFSBlobStore(mongoSession)
+	case "s3":
+		store, err = NewS3BlobStore(
+			config.S3Endpoint,
+			config.S3Bucket,
+			config.S3Region,
+			config.S3AccessKey,
+			config.S3SecretKey,
+			config.S3PathStyle,
+			config.S3PartSize,
+		)
+	default:
+		err = fmt.Errorf("unknown blob store %q", config.BlobStore)
+	}
+	if err != nil {
+		panic(fmt.Errorf("Error creating blob store: %s", err))
+	}
+	globalBlobStore = store
+}
+
+// cleanBlobName checks that name can't escape the store, for example through
+// "..", and returns it in a canonical form.
+func cleanBlobName(name string) (string, error) {
+	cleaned := path.Clean("/" + name)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(name, "/") {
+		return "", fmt.Errorf("invalid blob name %q", name)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const gridFSPrefix = "blobs"
+
+// GridFSBlobStore keeps blobs in MongoDB GridFS, so every instance of the app
+// can serve every image.
+type GridFSBlobStore struct {
+	Session *mgo.Session
+}
+
+// gridFSBlob is an open GridFS file together with the session it was read
+// through, which has to stay open until the file is closed.
+type gridFSBlob struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
+
+func (blob *gridFSBlob) Close() error {
+	err := blob.GridFile.Close()
+	blob.session.Close()
+	return err
+}
+
+func NewGridFSBlobStore(session *mgo.Session) (*GridFSBlobStore, error) {
+	store := &GridFSBlobStore{
+		Session: session,
+	}
+
+	db := store.Session.Copy()
+	defer db.Close()
+
+	// GridFS looks files up by name and picks the newest upload
+	err := db.DB(dbName).GridFS(gridFSPrefix).Files.EnsureIndex(mgo.Index{
+		Key: []string{"filename", "-uploadDate"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *GridFSBlobStore) Put(name string, r io.Reader) (int64, error) {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	db := store.Session.Copy()
+	defer db.Close()
+	gfs := db.DB(dbName).GridFS(gridFSPrefix)
+
+	file, err := gfs.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(file, r)
+	if err != nil {
+		file.Abort()
+		file.Close()
+		return 0, err
+	}
+	err = file.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// Now the new file is complete, drop any it replaces
+	var old struct {
+		ID interface{} `bson:"_id"`
+	}
+	iter := gfs.Find(bson.M{"filename": name, "_id": bson.M{"$ne": file.Id()}}).Select(bson.M{"_id": 1}).Iter()
+	for iter.Next(&old) {
+		err = gfs.RemoveId(old.ID)
+		if err != nil {
+			iter.Close()
+			return 0, err
+		}
+	}
+	return size, iter.Close()
+}
+
+func (store *GridFSBlobStore) Get(name string) (BlobReader, *BlobInfo, error) {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db := store.Session.Copy()
+	file, err := db.DB(dbName).GridFS(gridFSPrefix).Open(name)
+	if err != nil {
+		db.Close()
+		if err == mgo.ErrNotFound {
+			return nil, nil, errBlobNotFound
+		}
+		return nil, nil, err
+	}
+	return &gridFSBlob{file, db}, gridFSBlobInfo(file), nil
+}
+
+func (store *GridFSBlobStore) Delete(name string) error {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return err
+	}
+
+	db := store.Session.Copy()
+	defer db.Close()
+
+	return db.DB(dbName).GridFS(gridFSPrefix).Remove(name)
+}
+
+// Stat goes through Get, which cleans the name.
+func (store *GridFSBlobStore) Stat(name string) (*BlobInfo, error) {
+	blob, info, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	blob.Close()
+	return info, nil
+}
+
+func gridFSBlobInfo(file *mgo.GridFile) *BlobInfo {
+	return &BlobInfo{
+		Name:    file.Name(),
+		Size:    file.Size(),
+		ModTime: file.UploadDate(),
+	}
+}
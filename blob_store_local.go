@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LocalBlobStore keeps blobs on the local disk below root. Files are spread
+// over two levels of subdirectories picked by a hash of their name, so no
+// single directory ends up with all of them. "thumbnail/img_123.jpg" is
+// stored as root/thumbnail/3f/a1/img_123.jpg.
+//
+// Blobs written before sharding, straight into root, are still found.
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	err := os.MkdirAll(root, 0770)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{
+		root: root,
+	}, nil
+}
+
+// shardedPath returns where the blob with the given name is stored.
+func (store *LocalBlobStore) shardedPath(name string) string {
+	dir, file := filepath.Split(filepath.FromSlash(name))
+	sum := md5.Sum([]byte(file))
+	hash := hex.EncodeToString(sum[:])
+	return filepath.Join(store.root, dir, hash[0:2], hash[2:4], file)
+}
+
+// legacyPath returns where the blob was stored before sharding.
+func (store *LocalBlobStore) legacyPath(name string) string {
+	return filepath.Join(store.root, filepath.FromSlash(name))
+}
+
+// find returns the path of an existing blob.
+func (store *LocalBlobStore) find(name string) (string, os.FileInfo, error) {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, filename := range []string{store.shardedPath(name), store.legacyPath(name)} {
+		info, err := os.Stat(filename)
+		if err == nil && info.Mode().IsRegular() {
+			return filename, info, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", nil, err
+		}
+	}
+	return "", nil, errBlobNotFound
+}
+
+func (store *LocalBlobStore) Put(name string, r io.Reader) (int64, error) {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	filename := store.shardedPath(name)
+	err = os.MkdirAll(filepath.Dir(filename), 0770)
+	if err != nil {
+		return 0, err
+	}
+
+	// Write next to the target and rename, so readers never see half a file
+	tempFile, err := ioutil.TempFile(filepath.Dir(filename), ".upload")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tempFile.Name())
+
+	size, err := io.Copy(tempFile, r)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempFile.Name(), 0660)
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), filename)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Don't let an old unsharded copy shadow the new one after a delete
+	os.Remove(store.legacyPath(name))
+	return size, nil
+}
+
+func (store *LocalBlobStore) Get(name string) (BlobReader, *BlobInfo, error) {
+	filename, info, err := store.find(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, localBlobInfo(name, info), nil
+}
+
+func (store *LocalBlobStore) Delete(name string) error {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return err
+	}
+	for _, filename := range []string{store.shardedPath(name), store.legacyPath(name)} {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *LocalBlobStore) Stat(name string) (*BlobInfo, error) {
+	_, info, err := store.find(name)
+	if err != nil {
+		return nil, err
+	}
+	return localBlobInfo(name, info), nil
+}
+
+func localBlobInfo(name string, info os.FileInfo) *BlobInfo {
+	return &BlobInfo{
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Smallest part S3 accepts in a multipart upload, except for the last one
+const s3MinPartSize = 5 << 20
+
+// S3BlobStore keeps blobs in a bucket of any service that speaks the S3 REST
+// API, such as Amazon S3 itself or a local MinIO.
+//
+// Blobs of up to PartSize bytes are sent in one PUT, larger ones as a
+// multipart upload. Reads are made with range GETs, so seeking in a blob, as
+// http.ServeContent does for range requests, doesn't download what's skipped.
+type S3BlobStore struct {
+	Endpoint  *url.URL
+	Bucket    string
+	PathStyle bool
+	PartSize  int
+	Signer    *S3Signer
+	Client    *http.Client
+}
+
+// s3Error is the body of a failed S3 request.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (err *s3Error) Error() string {
+	return fmt.Sprintf("s3: %s: %s (%d)", err.Code, err.Message, err.StatusCode)
+}
+
+func NewS3BlobStore(endpoint, bucket, region, accessKey, secretKey string, pathStyle bool, partSize int) (*S3BlobStore, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %q needs a scheme and host", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("no s3 bucket given")
+	}
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+
+	return &S3BlobStore{
+		Endpoint:  u,
+		Bucket:    bucket,
+		PathStyle: pathStyle,
+		PartSize:  partSize,
+		Signer: &S3Signer{
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+			Region:    region,
+		},
+		Client: &http.Client{
+			// No overall timeout, bodies are streamed for as long as
+			// they take. Only waiting on the server is limited.
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				Dial:                  (&net.Dialer{Timeout: 10 * time.Second}).Dial,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// objectURL returns the URL of the object with the given name, with the path
+// escaped the same way it is when signing.
+func (store *S3BlobStore) objectURL(name string, query url.Values) *url.URL {
+	u := *store.Endpoint
+	objectPath := "/" + name
+	if store.PathStyle {
+		objectPath = "/" + store.Bucket + objectPath
+	} else {
+		u.Host = store.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = s3Escape(u.Path, true)
+	if query != nil {
+		u.RawQuery = s3CanonicalQuery(query)
+	}
+	return &u
+}
+
+// do signs and sends a request. Responses outside the 2xx range are turned
+// into an *s3Error.
+func (store *S3BlobStore) do(method string, u *url.URL, body []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	r, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	store.Signer.Sign(r, hexSHA256(body), time.Now())
+
+	response, err := store.Client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		return nil, readS3Error(response)
+	}
+	return response, nil
+}
+
+func readS3Error(response *http.Response) error {
+	s3Err := &s3Error{StatusCode: response.StatusCode}
+	// HEAD responses have no body, so there may be nothing to decode
+	xml.NewDecoder(io.LimitReader(response.Body, 1<<16)).Decode(s3Err)
+	if s3Err.Code == "" {
+		s3Err.Code = http.StatusText(response.StatusCode)
+	}
+	return s3Err
+}
+
+func isS3NotFound(err error) bool {
+	s3Err, ok := err.(*s3Error)
+	return ok && s3Err.StatusCode == http.StatusNotFound
+}
+
+func (store *S3BlobStore) Put(name string, r io.Reader) (int64, error) {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	// Anything that fits in one part goes up in a single request
+	part, err := store.readPart(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(part) < store.PartSize {
+		response, err := store.do("PUT", store.objectURL(name, nil), part, nil)
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		return int64(len(part)), nil
+	}
+	return store.putMultipart(name, part, r)
+}
+
+// readPart reads up to PartSize bytes from r. It returns fewer only at the
+// end of r.
+func (store *S3BlobStore) readPart(r io.Reader) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(r, int64(store.PartSize)))
+}
+
+// putMultipart uploads first, a full part, followed by the rest of r as a
+// multipart upload. The upload is aborted if anything goes wrong, so no
+// parts are left behind in the bucket.
+func (store *S3BlobStore) putMultipart(name string, first []byte, r io.Reader) (int64, error) {
+	response, err := store.do("POST", store.objectURL(name, url.Values{"uploads": {""}}), []byte{}, nil)
+	if err != nil {
+		return 0, err
+	}
+	initiated := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	err = xml.NewDecoder(response.Body).Decode(&initiated)
+	response.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := store.uploadParts(name, initiated.UploadID, first, r)
+	if err != nil {
+		abortURL := store.objectURL(name, url.Values{"uploadId": {initiated.UploadID}})
+		if response, abortErr := store.do("DELETE", abortURL, nil, nil); abortErr == nil {
+			response.Body.Close()
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (store *S3BlobStore) uploadParts(name, uploadID string, part []byte, r io.Reader) (int64, error) {
+	var size int64
+	complete := struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{}
+
+	for number := 1; len(part) > 0; number++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadID},
+		}
+		response, err := store.do("PUT", store.objectURL(name, query), part, nil)
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		complete.Parts = append(complete.Parts, s3CompletedPart{number, response.Header.Get("ETag")})
+		size += int64(len(part))
+
+		// Read the next part, which may be short or empty at the end
+		part, err = store.readPart(r)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return 0, err
+	}
+	response, err := store.do("POST", store.objectURL(name, url.Values{"uploadId": {uploadID}}), body, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	// Completing can fail after the 200 status has been sent, in which case
+	// the body holds an error instead of the result
+	result, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+	s3Err := &s3Error{StatusCode: response.StatusCode}
+	if xml.Unmarshal(result, s3Err) == nil && s3Err.Code != "" {
+		return 0, s3Err
+	}
+	return size, nil
+}
+
+func (store *S3BlobStore) Get(name string) (BlobReader, *BlobInfo, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &s3Object{store: store, name: info.Name, size: info.Size}, info, nil
+}
+
+func (store *S3BlobStore) Delete(name string) error {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return err
+	}
+	response, err := store.do("DELETE", store.objectURL(name, nil), nil, nil)
+	if isS3NotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (store *S3BlobStore) Stat(name string) (*BlobInfo, error) {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return nil, err
+	}
+	response, err := store.do("HEAD", store.objectURL(name, nil), nil, nil)
+	if isS3NotFound(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return &BlobInfo{
+		Name:    name,
+		Size:    response.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+// URL returns a presigned URL that lets a browser fetch the blob straight
+// from the bucket until it expires.
+func (store *S3BlobStore) URL(name string, expires time.Duration) (string, error) {
+	name, err := cleanBlobName(name)
+	if err != nil {
+		return "", err
+	}
+	return store.Signer.Presign(store.objectURL(name, nil), expires, time.Now()).String(), nil
+}
+
+// s3Object reads an object with range GETs. A request is only made on the
+// first read after opening or seeking.
+type s3Object struct {
+	store  *S3BlobStore
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (object *s3Object) Read(p []byte) (int, error) {
+	if object.offset >= object.size {
+		return 0, io.EOF
+	}
+	if object.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", object.offset))
+		response, err := object.store.do("GET", object.store.objectURL(object.name, nil), nil, header)
+		if err != nil {
+			return 0, err
+		}
+		object.body = response.Body
+	}
+
+	n, err := object.body.Read(p)
+	object.offset += int64(n)
+	return n, err
+}
+
+func (object *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 1:
+		offset += object.offset
+	case 2:
+		offset += object.size
+	}
+	if offset < 0 {
+		return object.offset, fmt.Errorf("s3: seek to negative offset")
+	}
+	if offset != object.offset && object.body != nil {
+		object.body.Close()
+		object.body = nil
+	}
+	object.offset = offset
+	return offset, nil
+}
+
+func (object *s3Object) Close() error {
+	if object.body == nil {
+		return nil
+	}
+	err := object.body.Close()
+	object.body = nil
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestS3BlobStore returns a store for the bucket given by the
+// GOPHR_TEST_S3_* variables, or skips the test if there is none. The bucket
+// has to exist already, as it does after
+//
+//	mc mb local/gophr-test
+//
+// on a MinIO started with `minio server`, tested with
+//
+//	GOPHR_TEST_S3_ENDPOINT=http://localhost:9000 GOPHR_TEST_S3_BUCKET=gophr-test \
+//	GOPHR_TEST_S3_ACCESS_KEY=minioadmin GOPHR_TEST_S3_SECRET_KEY=minioadmin go test -run S3
+func newTestS3BlobStore(t *testing.T) *S3BlobStore {
+	endpoint := os.Getenv("GOPHR_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("GOPHR_TEST_S3_ENDPOINT is not set")
+	}
+	store, err := NewS3BlobStore(
+		endpoint,
+		os.Getenv("GOPHR_TEST_S3_BUCKET"),
+		getenv("GOPHR_TEST_S3_REGION", "us-east-1"),
+		os.Getenv("GOPHR_TEST_S3_ACCESS_KEY"),
+		os.Getenv("GOPHR_TEST_S3_SECRET_KEY"),
+		getenv("GOPHR_TEST_S3_PATH_STYLE", "true") == "true",
+		s3MinPartSize,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestS3BlobStoreRoundTrip(t *testing.T) {
+	store := newTestS3BlobStore(t)
+
+	// One blob sent in a single PUT, one large enough to go in parts
+	small := []byte("Gophr was here")
+	large := bytes.Repeat([]byte("0123456789abcdef"), (s3MinPartSize+s3MinPartSize/2)/16)
+	for _, contents := range [][]byte{small, large} {
+		name := "gophr-test/" + GenerateID("tst", 8) + ".bin"
+		defer store.Delete(name)
+
+		n, err := store.Put(name, bytes.NewReader(contents))
+		if err != nil {
+			t.Fatalf("Put %s: %s", name, err)
+		}
+		if n != int64(len(contents)) {
+			t.Errorf("Put %s stored %d bytes, want %d", name, n, len(contents))
+		}
+
+		info, err := store.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat %s: %s", name, err)
+		}
+		if info.Name != name || info.Size != int64(len(contents)) || info.ModTime.IsZero() {
+			t.Errorf("Stat %s = %+v", name, info)
+		}
+
+		blob, _, err := store.Get(name)
+		if err != nil {
+			t.Fatalf("Get %s: %s", name, err)
+		}
+		got, err := ioutil.ReadAll(blob)
+		if err != nil || !bytes.Equal(got, contents) {
+			t.Errorf("Get %s read %d bytes (%v), want %d", name, len(got), err, len(contents))
+		}
+		// Seeking makes the next read a range GET from there
+		_, err = blob.Seek(-4, 2)
+		if err == nil {
+			got, err = ioutil.ReadAll(blob)
+		}
+		if err != nil || !bytes.Equal(got, contents[len(contents)-4:]) {
+			t.Errorf("Get %s after seeking read %q (%v), want %q", name, got, err, contents[len(contents)-4:])
+		}
+		blob.Close()
+
+		url, err := store.URL(name, time.Minute)
+		if err != nil {
+			t.Fatalf("URL %s: %s", name, err)
+		}
+		response, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("GET presigned URL of %s: %s", name, err)
+		}
+		got, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK || err != nil || !bytes.Equal(got, contents) {
+			t.Errorf("GET presigned URL of %s: status %d, %d bytes (%v)", name, response.StatusCode, len(got), err)
+		}
+
+		err = store.Delete(name)
+		if err != nil {
+			t.Fatalf("Delete %s: %s", name, err)
+		}
+		if _, err = store.Stat(name); err != errBlobNotFound {
+			t.Errorf("Stat %s after Delete = %v, want errBlobNotFound", name, err)
+		}
+		if _, _, err = store.Get(name); err != errBlobNotFound {
+			t.Errorf("Get %s after Delete = %v, want errBlobNotFound", name, err)
+		}
+		// Deleting a missing blob is not an error
+		if err = store.Delete(name); err != nil {
+			t.Errorf("Delete %s again: %s", name, err)
+		}
+	}
+}
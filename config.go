@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings that change from one deployment to another.
+// Every value can be overridden with the environment variable noted next to it.
+type Config struct {
+	MongoHost string // GOPHR_MONGO_HOST
+	UserStore string // GOPHR_USER_STORE, "mongo" or "file"
+	UserFile  string // GOPHR_USER_FILE
+
+	SessionStore string // GOPHR_SESSION_STORE, "mongo" or "file"
+	SessionFile  string // GOPHR_SESSION_FILE
+
+	// File based stores either rewrite their file on every change
+	// ("snapshot") or append changes to a journal ("journal"), which is
+	// folded into the file once it reaches FileStoreCompactSize bytes.
+	FileStoreMode        string // GOPHR_FILE_STORE_MODE
+	FileStoreCompactSize int64  // GOPHR_FILE_STORE_COMPACT_SIZE
+
+	BlobStore string // GOPHR_BLOB_STORE, "local", "gridfs" or "s3"
+	BlobRoot  string // GOPHR_BLOB_ROOT
+
+	// Images are either proxied through /im/ ("proxy") or, when the blob
+	// store supports it, served by redirecting to a presigned URL
+	// ("redirect") that is valid for ImageRedirectExpiry.
+	ImageServing        string        // GOPHR_IMAGE_SERVING
+	ImageRedirectExpiry time.Duration // GOPHR_IMAGE_REDIRECT_EXPIRY
+
+	S3Endpoint  string // GOPHR_S3_ENDPOINT
+	S3Region    string // GOPHR_S3_REGION
+	S3Bucket    string // GOPHR_S3_BUCKET
+	S3AccessKey string // GOPHR_S3_ACCESS_KEY
+	S3SecretKey string // GOPHR_S3_SECRET_KEY
+	S3PathStyle bool   // GOPHR_S3_PATH_STYLE
+	S3PartSize  int    // GOPHR_S3_PART_SIZE
+
+	// Deleted images stay in the trash this long before they are purged
+	TrashRetention time.Duration // GOPHR_TRASH_RETENTION
+
+	// A JSON file with the list of renditions to generate, replacing the
+	// built in thumbnail, preview and square
+	RenditionsFile string // GOPHR_RENDITIONS_FILE
+
+	// On-demand transformations below /im/img_.../ are limited to
+	// TransformMaxSize pixels a side, of the TransformSizes and
+	// TransformQualities listed, so only so many of them can be cached per
+	// image. They run at most TransformWorkers at a time and are cached in
+	// TransformCacheDir up to TransformCacheSize bytes.
+	TransformMaxSize   int    // GOPHR_TRANSFORM_MAX_SIZE
+	TransformSizes     []int  // GOPHR_TRANSFORM_SIZES
+	TransformQualities []int  // GOPHR_TRANSFORM_QUALITIES
+	TransformWorkers   int    // GOPHR_TRANSFORM_WORKERS
+	TransformCacheDir  string // GOPHR_TRANSFORM_CACHE_DIR
+	TransformCacheSize int64  // GOPHR_TRANSFORM_CACHE_SIZE
+
+	// How many bits the perceptual hashes of images may differ in for them
+	// to be shown as similar, at most 7
+	SimilarImageDistance int // GOPHR_SIMILAR_IMAGE_DISTANCE
+
+	// Renditions of uploads are generated in the background by this many
+	// workers, each decoding one image at a time
+	ProcessingWorkers int // GOPHR_PROCESSING_WORKERS
+
+	// Uploads are refused if the file is larger than UploadMaxSize bytes,
+	// or the picture wider or taller than UploadMaxDimension or larger
+	// than UploadMaxPixels pixels in all, before anything is decoded
+	UploadMaxSize      int64 // GOPHR_UPLOAD_MAX_SIZE
+	UploadMaxDimension int   // GOPHR_UPLOAD_MAX_DIMENSION
+	UploadMaxPixels    int   // GOPHR_UPLOAD_MAX_PIXELS
+
+	// Resumable uploads are kept in the blob store until they're complete,
+	// or until nothing was added to them for UploadExpiry. A user may have
+	// UploadMaxOpen of them going at once.
+	UploadExpiry  time.Duration // GOPHR_UPLOAD_EXPIRY
+	UploadMaxOpen int           // GOPHR_UPLOAD_MAX_OPEN
+}
+
+var config = LoadConfig()
+
+// LoadConfig reads the configuration from the environment, falling back to
+// defaults suitable for a single development machine.
+func LoadConfig() Config {
+	return Config{
+		MongoHost: getenv("GOPHR_MONGO_HOST", "localhost"),
+		UserStore: getenv("GOPHR_USER_STORE", "mongo"),
+		UserFile:  getenv("GOPHR_USER_FILE", "./data/users.json"),
+
+		SessionStore: getenv("GOPHR_SESSION_STORE", "file"),
+		SessionFile:  getenv("GOPHR_SESSION_FILE", "./data/sessions.json"),
+
+		FileStoreMode:        getenv("GOPHR_FILE_STORE_MODE", "snapshot"),
+		FileStoreCompactSize: int64(getenvInt("GOPHR_FILE_STORE_COMPACT_SIZE", 1<<20)),
+
+		BlobStore: getenv("GOPHR_BLOB_STORE", "local"),
+		BlobRoot:  getenv("GOPHR_BLOB_ROOT", "./data/images"),
+
+		ImageServing:        getenv("GOPHR_IMAGE_SERVING", "proxy"),
+		ImageRedirectExpiry: getenvDuration("GOPHR_IMAGE_REDIRECT_EXPIRY", time.Hour),
+
+		S3Endpoint:  getenv("GOPHR_S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Region:    getenv("GOPHR_S3_REGION", "us-east-1"),
+		S3Bucket:    getenv("GOPHR_S3_BUCKET", ""),
+		S3AccessKey: getenv("GOPHR_S3_ACCESS_KEY", ""),
+		S3SecretKey: getenv("GOPHR_S3_SECRET_KEY", ""),
+		S3PathStyle: getenv("GOPHR_S3_PATH_STYLE", "true") == "true",
+		S3PartSize:  getenvInt("GOPHR_S3_PART_SIZE", 8<<20),
+
+		TrashRetention: getenvDuration("GOPHR_TRASH_RETENTION", 30*24*time.Hour),
+
+		RenditionsFile: getenv("GOPHR_RENDITIONS_FILE", ""),
+
+		TransformMaxSize:   getenvInt("GOPHR_TRANSFORM_MAX_SIZE", 2048),
+		TransformSizes:     getenvInts("GOPHR_TRANSFORM_SIZES", []int{32, 64, 100, 128, 160, 200, 240, 256, 320, 400, 480, 512, 600, 640, 720, 800, 960, 1024, 1080, 1200, 1280, 1440, 1600, 1920, 2048}),
+		TransformQualities: getenvInts("GOPHR_TRANSFORM_QUALITIES", []int{50, 60, 70, 75, 80, 85, 90, 95, 100}),
+		TransformWorkers:   getenvInt("GOPHR_TRANSFORM_WORKERS", runtime.NumCPU()),
+		TransformCacheDir:  getenv("GOPHR_TRANSFORM_CACHE_DIR", "./data/cache"),
+		TransformCacheSize: int64(getenvInt("GOPHR_TRANSFORM_CACHE_SIZE", 256<<20)),
+
+		SimilarImageDistance: getenvInt("GOPHR_SIMILAR_IMAGE_DISTANCE", 6),
+
+		ProcessingWorkers: getenvInt("GOPHR_PROCESSING_WORKERS", 2),
+
+		UploadMaxSize:      int64(getenvInt("GOPHR_UPLOAD_MAX_SIZE", 64<<20)),
+		UploadMaxDimension: getenvInt("GOPHR_UPLOAD_MAX_DIMENSION", 12000),
+		UploadMaxPixels:    getenvInt("GOPHR_UPLOAD_MAX_PIXELS", 50000000),
+
+		UploadExpiry:  getenvDuration("GOPHR_UPLOAD_EXPIRY", 24*time.Hour),
+		UploadMaxOpen: getenvInt("GOPHR_UPLOAD_MAX_OPEN", 10),
+	}
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getenvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getenvInts reads a comma separated list of numbers.
+func getenvInts(key string, fallback []int) []int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	numbers := []int{}
+	for _, field := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return fallback
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
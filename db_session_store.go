@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+const sessionsCollectionName = "sessions"
+
+// DBSessionStore keeps sessions in MongoDB. A TTL index on the expiry lets
+// MongoDB remove sessions once they run out, whether or not anybody comes
+// back with the cookie.
+type DBSessionStore struct {
+	Session *mgo.Session
+}
+
+func NewDBSessionStore(session *mgo.Session) (*DBSessionStore, error) {
+	store := &DBSessionStore{
+		Session: session,
+	}
+
+	db := store.Session.Copy()
+	defer db.Close()
+
+	// mgo leaves out an ExpireAfter of zero, so ask for the smallest delay
+	// it will send. The TTL monitor only runs once a minute anyway.
+	err := db.DB(dbName).C(sessionsCollectionName).EnsureIndex(mgo.Index{
+		Key:         []string{"expiry"},
+		ExpireAfter: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *DBSessionStore) Save(session Session) error {
+	db := store.Session.Copy()
+	defer db.Close()
+
+	_, err := db.DB(dbName).C(sessionsCollectionName).UpsertId(session.ID, session)
+	return err
+}
+
+func (store *DBSessionStore) Find(id string) (*Session, error) {
+	db := store.Session.Copy()
+	defer db.Close()
+
+	session := &Session{}
+	err := db.DB(dbName).C(sessionsCollectionName).FindId(id).One(session)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (store *DBSessionStore) Delete(session *Session) error {
+	db := store.Session.Copy()
+	defer db.Close()
+
+	err := db.DB(dbName).C(sessionsCollectionName).RemoveId(session.ID)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
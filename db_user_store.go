@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const usersCollectionName = "users"
+
+// DBUserStore keeps users in MongoDB so every instance of the app sees the
+// same accounts.
+type DBUserStore struct {
+	Session *mgo.Session
+}
+
+// dbUser is the document stored for each user. The lower-cased copies of the
+// username and email carry the unique indexes, which makes both of them
+// case-insensitive.
+type dbUser struct {
+	User        `bson:",inline"`
+	UserNameKey string `bson:"username_key"`
+	EmailKey    string `bson:"email_key"`
+}
+
+func NewDBUserStore(session *mgo.Session) (*DBUserStore, error) {
+	store := &DBUserStore{
+		Session: session,
+	}
+
+	db := store.Session.Copy()
+	defer db.Close()
+
+	c := db.DB(dbName).C(usersCollectionName)
+	for _, key := range []string{"username_key", "email_key"} {
+		err := c.EnsureIndex(mgo.Index{
+			Key:    []string{key},
+			Unique: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func (store *DBUserStore) Save(user User) error {
+	db := store.Session.Copy()
+	defer db.Close()
+
+	doc := dbUser{
+		User:        user,
+		UserNameKey: strings.ToLower(user.UserName),
+		EmailKey:    strings.ToLower(user.Email),
+	}
+	_, err := db.DB(dbName).C(usersCollectionName).UpsertId(user.ID, doc)
+	if mgo.IsDup(err) {
+		// Another instance got there between our check and the save
+		if strings.Contains(err.Error(), "email_key") {
+			return errEmailExist
+		}
+		return errUsernameExist
+	}
+	return err
+}
+
+func (store *DBUserStore) Find(id string) (*User, error) {
+	return store.findOne(bson.M{"_id": id})
+}
+
+func (store *DBUserStore) FindByUsername(username string) (*User, error) {
+	if username == "" {
+		return nil, nil
+	}
+	return store.findOne(bson.M{"username_key": strings.ToLower(username)})
+}
+
+func (store *DBUserStore) FindByEmail(email string) (*User, error) {
+	if email == "" {
+		return nil, nil
+	}
+	return store.findOne(bson.M{"email_key": strings.ToLower(email)})
+}
+
+func (store *DBUserStore) findOne(query bson.M) (*User, error) {
+	db := store.Session.Copy()
+	defer db.Close()
+
+	doc := dbUser{}
+	err := db.DB(dbName).C(usersCollectionName).Find(query).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc.User, nil
+}
+
+// MigrateFileUsers imports the users of a FileUserStore file into store and
+// returns how many were added. Users that already exist are left alone, and
+// those whose username or email another user has taken are logged and
+// skipped. Once every other user has been imported the file, and any
+// journal, is renamed with an ".imported" suffix, so the migration only
+// happens once. If anything else fails nothing is renamed, and the next start
+// carries on where this one stopped.
+//
+// A journal left behind is always replayed, whatever GOPHR_FILE_STORE_MODE
+// says now, as the users saved since the last snapshot are only in it.
+func MigrateFileUsers(filename string, store UserStore) (int, error) {
+	_, err := os.Stat(filename)
+	_, journalErr := os.Stat(filename + ".journal")
+	_, oldJournalErr := os.Stat(filename + ".journal.old")
+	hasJournal := !os.IsNotExist(journalErr) || !os.IsNotExist(oldJournalErr)
+	if os.IsNotExist(err) && !hasJournal {
+		return 0, nil
+	}
+
+	fileStore, err := newFileUserStore(filename, hasJournal || config.FileStoreMode == "journal")
+	if err != nil {
+		return 0, err
+	}
+	defer fileStore.Close()
+
+	imported, skipped := 0, 0
+	for _, user := range fileStore.Users {
+		existingUser, err := store.Find(user.ID)
+		if err != nil {
+			return imported, err
+		}
+		if existingUser != nil {
+			continue
+		}
+		err = store.Save(user)
+		if err == errUsernameExist || err == errEmailExist {
+			// The file is kept, renamed, so they can be sorted out by hand
+			log.Printf("Not importing user %s (%s) from %s: %s", user.UserName, user.ID, filename, err)
+			skipped++
+			continue
+		}
+		if err != nil {
+			return imported, fmt.Errorf("importing user %s: %s", user.UserName, err)
+		}
+		imported++
+	}
+
+	fileStore.Close()
+	if skipped > 0 {
+		log.Printf("Imported %d users from %s, and skipped %d", imported, filename, skipped)
+	}
+
+	// A journaled store may only have some of these files
+	for _, name := range []string{filename, filename + ".journal", filename + ".journal.old"} {
+		err = os.Rename(name, name+".imported")
+		if err != nil && !os.IsNotExist(err) {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
@@ -1,23 +1,53 @@
 package main
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
-type ValidationError error
+// ValidationError is a mistake of the user's, shown to them so they can fix
+// it. Any other error is the server's own, and isn't.
+type ValidationError struct {
+	error
+}
 
 var (
-	errNoUserName           = ValidationError(errors.New("You must supply a username"))
-	errNoEmail              = ValidationError(errors.New("You must supply an email"))
-	errNoPassword           = ValidationError(errors.New("You must supply a password"))
-	errPasswordTooShort     = ValidationError(errors.New("You password is too short"))
-	errUsernameExist        = ValidationError(errors.New("That username is taken"))
-	errEmailExist           = ValidationError(errors.New("That email address has an account"))
-	errCredentialsIncorrect = ValidationError(errors.New("We couldn't find a user with the supplied username and password combination"))
-	errPasswordIncorrect    = ValidationError(errors.New("Password did not match"))
+	errNoUserName           = ValidationError{errors.New("You must supply a username")}
+	errNoEmail              = ValidationError{errors.New("You must supply an email")}
+	errNoPassword           = ValidationError{errors.New("You must supply a password")}
+	errPasswordTooShort     = ValidationError{errors.New("You password is too short")}
+	errUsernameExist        = ValidationError{errors.New("That username is taken")}
+	errEmailExist           = ValidationError{errors.New("That email address has an account")}
+	errCredentialsIncorrect = ValidationError{errors.New("We couldn't find a user with the supplied username and password combination")}
+	errPasswordIncorrect    = ValidationError{errors.New("Password did not match")}
 
 	// Image manipulation error
-	errInvalidImageType = ValidationError(errors.New("Please upload only jpeg, gif, or png images"))
-	errNoImage          = ValidationError(errors.New("Please select an image to upload"))
-	errImageURLInvalid  = ValidationError(errors.New("Couldn't download image fron URL you provided"))
+	errInvalidImageType   = ValidationError{errors.New("Please upload only jpeg, gif, png, tiff or bmp images")}
+	errNoImage            = ValidationError{errors.New("Please select an image to upload")}
+	errImageURLInvalid    = ValidationError{errors.New("Couldn't download image fron URL you provided")}
+	errImageURLForbidden  = ValidationError{errors.New("Images can't be downloaded from that address")}
+	errNoImageTitle       = ValidationError{errors.New("Please give the image a title")}
+	errDuplicateImage     = ValidationError{errors.New("You already have an image that looks just like this one")}
+	errInvalidImage       = ValidationError{errors.New("The file couldn't be read as an image")}
+	errUploadFailed       = ValidationError{errors.New("The upload didn't come through, please try again")}
+	errImageTooLarge      = ValidationError{fmt.Errorf("Please upload images of at most %d MB", config.UploadMaxSize>>20)}
+	errImageTooManyPixels = ValidationError{fmt.Errorf("Please upload images of at most %d pixels a side and %d megapixels",
+		config.UploadMaxDimension, config.UploadMaxPixels/1000000)}
+
+	// Image editing error
+	errInvalidAdjustment  = ValidationError{errors.New("Please check the values of your adjustments")}
+	errTooManyAdjustments = ValidationError{errors.New("You can't have more than 20 adjustments")}
+	errCropOutsideImage   = ValidationError{errors.New("The crop doesn't overlap the image")}
+	errInvalidVersion     = ValidationError{errors.New("That version of the image doesn't exist")}
+	errInvalidFocalPoint  = ValidationError{errors.New("The focal point must be within the image")}
+	errImageNotReady      = ValidationError{errors.New("The image can only be edited once it has been processed")}
+	errEditPending        = ValidationError{errors.New("Your last change is still being made, please wait for it")}
+	errEditFailed         = ValidationError{errors.New("Your last change couldn't be made, please try again")}
+
+	// Privacy settings error
+	errInvalidMetadataPolicy = ValidationError{errors.New("Please choose what happens to the metadata of your photos")}
+	errInvalidPrivacyZone    = ValidationError{errors.New("A privacy zone needs a valid latitude, longitude and a radius of up to 50 km")}
+	errTooManyPrivacyZones   = ValidationError{errors.New("You can't have more than 20 privacy zones")}
 )
 
 func IsValidationError(err error) bool {
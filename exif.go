@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// EXIF tags read from the first IFD
+const (
+	exifTagMake        = 0x010F
+	exifTagModel       = 0x0110
+	exifTagOrientation = 0x0112
+	exifTagExifIFD     = 0x8769
+	exifTagGPSIFD      = 0x8825
+)
+
+// EXIF tags read from the Exif IFD
+const (
+	exifTagExposureTime     = 0x829A
+	exifTagFNumber          = 0x829D
+	exifTagISO              = 0x8827
+	exifTagDateTimeOriginal = 0x9003
+	exifTagFocalLength      = 0x920A
+	exifTagLensMake         = 0xA433
+	exifTagLensModel        = 0xA434
+)
+
+// EXIF tags read from the GPS IFD
+const (
+	exifTagGPSLatitudeRef  = 0x0001
+	exifTagGPSLatitude     = 0x0002
+	exifTagGPSLongitudeRef = 0x0003
+	exifTagGPSLongitude    = 0x0004
+)
+
+const exifDateFormat = "2006:01:02 15:04:05"
+
+// ImageEXIF is what we keep of the EXIF metadata of an upload.
+type ImageEXIF struct {
+	Make         string       `bson:"make,omitempty"`
+	Model        string       `bson:"model,omitempty"`
+	Lens         string       `bson:"lens,omitempty"`
+	ExposureTime string       `bson:"exposure_time,omitempty"` // in seconds, such as "1/250"
+	FNumber      float64      `bson:"f_number,omitempty"`
+	ISO          int          `bson:"iso,omitempty"`
+	FocalLength  float64      `bson:"focal_length,omitempty"` // in mm
+	DateTaken    *time.Time   `bson:"date_taken,omitempty"`   // in the camera's time zone, which isn't recorded
+	GPS          *GPSPosition `bson:"gps,omitempty"`
+	// How the image has to be turned to be upright, 1 to 8 as in the EXIF
+	// Orientation tag
+	Orientation int `bson:"orientation,omitempty"`
+}
+
+type GPSPosition struct {
+	Latitude  float64 `bson:"latitude"`
+	Longitude float64 `bson:"longitude"`
+}
+
+// ReadEXIF reads the EXIF metadata of a JPEG image. It returns nil if r
+// isn't a JPEG or has no EXIF block.
+func ReadEXIF(r io.Reader) (*ImageEXIF, error) {
+	block, err := jpegEXIFBlock(bufio.NewReader(r))
+	if err != nil || block == nil {
+		return nil, err
+	}
+	return parseEXIF(block)
+}
+
+// jpegEXIFBlock finds the APP1 segment holding the EXIF block of a JPEG and
+// returns the TIFF structure in it. EXIF comes before the image data, so
+// only the first segments are read.
+func jpegEXIFBlock(r *bufio.Reader) ([]byte, error) {
+	soi := make([]byte, 2)
+	_, err := io.ReadFull(r, soi)
+	if err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, nil
+	}
+
+	for {
+		marker := make([]byte, 2)
+		_, err = io.ReadFull(r, marker)
+		if err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xFF {
+			return nil, errInvalidTIFF
+		}
+		// Padding before a marker
+		if marker[1] == 0xFF {
+			r.UnreadByte()
+			continue
+		}
+		// Start of scan or end of image, there's no EXIF
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return nil, nil
+		}
+
+		var length uint16
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, errInvalidTIFF
+		}
+		segment := make([]byte, length-2)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return nil, err
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+func parseEXIF(block []byte) (*ImageEXIF, error) {
+	tiff, offset, err := newTIFFData(block)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, _, err := tiff.readIFD(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &ImageEXIF{
+		Make:  tiff.ascii(ifd0, exifTagMake),
+		Model: tiff.ascii(ifd0, exifTagModel),
+	}
+	if orientation, ok := tiff.uint(ifd0, exifTagOrientation, 0); ok && orientation >= 1 && orientation <= 8 {
+		exif.Orientation = int(orientation)
+	}
+
+	// The rest is optional, and a broken sub-IFD only loses its own fields
+	if offset, ok := tiff.uint(ifd0, exifTagExifIFD, 0); ok {
+		if ifd, _, err := tiff.readIFD(offset); err == nil {
+			exif.readExifIFD(tiff, ifd)
+		}
+	}
+	if offset, ok := tiff.uint(ifd0, exifTagGPSIFD, 0); ok {
+		if ifd, _, err := tiff.readIFD(offset); err == nil {
+			exif.readGPSIFD(tiff, ifd)
+		}
+	}
+	return exif, nil
+}
+
+func (exif *ImageEXIF) readExifIFD(tiff *tiffData, ifd tiffIFD) {
+	exif.Lens = tiff.ascii(ifd, exifTagLensModel)
+	if lensMake := tiff.ascii(ifd, exifTagLensMake); lensMake != "" && !strings.HasPrefix(exif.Lens, lensMake) {
+		exif.Lens = strings.TrimSpace(lensMake + " " + exif.Lens)
+	}
+
+	if num, den, ok := tiff.rational(ifd, exifTagExposureTime, 0); ok && num > 0 {
+		if num >= den {
+			exif.ExposureTime = fmt.Sprintf("%g", float64(num)/float64(den))
+		} else {
+			exif.ExposureTime = fmt.Sprintf("1/%d", int64(math.Floor(float64(den)/float64(num)+0.5)))
+		}
+	}
+	if fNumber, ok := tiff.float(ifd, exifTagFNumber, 0); ok {
+		exif.FNumber = fNumber
+	}
+	if iso, ok := tiff.uint(ifd, exifTagISO, 0); ok {
+		exif.ISO = int(iso)
+	}
+	if focalLength, ok := tiff.float(ifd, exifTagFocalLength, 0); ok {
+		exif.FocalLength = focalLength
+	}
+	if taken, err := time.Parse(exifDateFormat, tiff.ascii(ifd, exifTagDateTimeOriginal)); err == nil {
+		exif.DateTaken = &taken
+	}
+}
+
+func (exif *ImageEXIF) readGPSIFD(tiff *tiffData, ifd tiffIFD) {
+	latitude, ok := gpsCoordinate(tiff, ifd, exifTagGPSLatitude, tiff.ascii(ifd, exifTagGPSLatitudeRef) == "S")
+	if !ok || latitude < -90 || latitude > 90 {
+		return
+	}
+	longitude, ok := gpsCoordinate(tiff, ifd, exifTagGPSLongitude, tiff.ascii(ifd, exifTagGPSLongitudeRef) == "W")
+	if !ok || longitude < -180 || longitude > 180 {
+		return
+	}
+	exif.GPS = &GPSPosition{Latitude: latitude, Longitude: longitude}
+}
+
+// gpsCoordinate reads a latitude or longitude stored as degrees, minutes and
+// seconds.
+func gpsCoordinate(tiff *tiffData, ifd tiffIFD, tag uint16, negative bool) (float64, bool) {
+	var value float64
+	for i, unit := range []float64{1, 60, 3600} {
+		part, ok := tiff.float(ifd, tag, i)
+		if !ok {
+			return 0, false
+		}
+		value += part / unit
+	}
+	if negative {
+		value = -value
+	}
+	return value, true
+}
+
+// Orient turns img upright as the EXIF Orientation tag asks.
+func (exif *ImageEXIF) Orient(img image.Image) image.Image {
+	if exif == nil {
+		return img
+	}
+	switch exif.Orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// These methods are called by the metadata panel of images/show
+
+// Camera names the camera, without repeating the make if the model
+// already starts with it.
+func (exif *ImageEXIF) Camera() string {
+	if strings.HasPrefix(strings.ToLower(exif.Model), strings.ToLower(exif.Make)) {
+		return exif.Model
+	}
+	return strings.TrimSpace(exif.Make + " " + exif.Model)
+}
+
+// Exposure sums up the exposure settings, as in "1/250s f/2.8 ISO 100".
+func (exif *ImageEXIF) Exposure() string {
+	parts := []string{}
+	if exif.ExposureTime != "" {
+		parts = append(parts, exif.ExposureTime+"s")
+	}
+	if exif.FNumber != 0 {
+		parts = append(parts, fmt.Sprintf("f/%.3g", exif.FNumber))
+	}
+	if exif.ISO != 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", exif.ISO))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (exif *ImageEXIF) FocalLengthString() string {
+	if exif.FocalLength == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.4gmm", exif.FocalLength)
+}
+
+func (exif *ImageEXIF) MapURL() string {
+	if exif.GPS == nil {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f#map=15/%.6f/%.6f",
+		exif.GPS.Latitude, exif.GPS.Longitude, exif.GPS.Latitude, exif.GPS.Longitude)
+}
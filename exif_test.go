@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// exifField is a field of an IFD built by exifBuilder, with its value
+// already encoded. Fields with Sub point at an IFD of their own.
+type exifField struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Value []byte
+	Sub   []exifField
+}
+
+// exifBuilder lays out a TIFF structure, as found in an EXIF block or a TIFF
+// file, for the tests to read and strip.
+type exifBuilder struct {
+	order binary.ByteOrder
+	data  []byte
+}
+
+func newEXIFBuilder(order binary.ByteOrder) *exifBuilder {
+	b := &exifBuilder{order: order, data: make([]byte, 8)}
+	if order == binary.LittleEndian {
+		copy(b.data, "II")
+	} else {
+		copy(b.data, "MM")
+	}
+	order.PutUint16(b.data[2:], 42)
+	order.PutUint32(b.data[4:], 8)
+	return b
+}
+
+// ifd appends an IFD with fields, followed by the values that don't fit in
+// their entries and then the IFDs they point at, and returns its offset.
+func (b *exifBuilder) ifd(fields []exifField) uint32 {
+	start := len(b.data)
+	b.data = append(b.data, make([]byte, 2+12*len(fields)+4)...)
+	b.order.PutUint16(b.data[start:], uint16(len(fields)))
+
+	type pointer struct {
+		slot   int
+		fields []exifField
+	}
+	var pointers []pointer
+	for i, field := range fields {
+		entry := start + 2 + 12*i
+		b.order.PutUint16(b.data[entry:], field.Tag)
+		b.order.PutUint16(b.data[entry+2:], field.Type)
+		b.order.PutUint32(b.data[entry+4:], field.Count)
+		switch {
+		case field.Sub != nil:
+			pointers = append(pointers, pointer{entry + 8, field.Sub})
+		case len(field.Value) <= 4:
+			copy(b.data[entry+8:], field.Value)
+		default:
+			b.order.PutUint32(b.data[entry+8:], uint32(len(b.data)))
+			b.data = append(b.data, field.Value...)
+		}
+	}
+	for _, p := range pointers {
+		// Appending may move the data, so it's only indexed after
+		offset := b.ifd(p.fields)
+		b.order.PutUint32(b.data[p.slot:], offset)
+	}
+	return uint32(start)
+}
+
+// link makes the IFD at to follow the one at from.
+func (b *exifBuilder) link(from, to uint32) {
+	count := uint32(b.order.Uint16(b.data[from:]))
+	b.order.PutUint32(b.data[from+2+12*count:], to)
+}
+
+// build returns the structure with fields as its first IFD.
+func (b *exifBuilder) build(fields ...exifField) []byte {
+	b.ifd(fields)
+	return b.data
+}
+
+func (b *exifBuilder) ascii(tag uint16, value string) exifField {
+	return exifField{Tag: tag, Type: tiffASCII, Count: uint32(len(value) + 1), Value: append([]byte(value), 0)}
+}
+
+func (b *exifBuilder) short(tag uint16, value uint16) exifField {
+	field := exifField{Tag: tag, Type: tiffShort, Count: 1, Value: make([]byte, 2)}
+	b.order.PutUint16(field.Value, value)
+	return field
+}
+
+// rational takes pairs of numerators and denominators.
+func (b *exifBuilder) rational(tag uint16, values ...uint32) exifField {
+	field := exifField{Tag: tag, Type: tiffRational, Count: uint32(len(values) / 2), Value: make([]byte, 4*len(values))}
+	for i, value := range values {
+		b.order.PutUint32(field.Value[4*i:], value)
+	}
+	return field
+}
+
+func (b *exifBuilder) undefined(tag uint16, value string) exifField {
+	return exifField{Tag: tag, Type: tiffUndefined, Count: uint32(len(value)), Value: []byte(value)}
+}
+
+func subIFD(tag, fieldType uint16, fields ...exifField) exifField {
+	return exifField{Tag: tag, Type: fieldType, Count: 1, Sub: fields}
+}
+
+// cameraEXIF builds the EXIF block of a photo taken in Berlin by a camera
+// that records everything we read.
+func cameraEXIF(order binary.ByteOrder, pointerType uint16) []byte {
+	b := newEXIFBuilder(order)
+	return b.build(
+		b.ascii(exifTagMake, "Canon"),
+		b.ascii(exifTagModel, "Canon EOS 5D Mark III"),
+		b.short(exifTagOrientation, 6),
+		subIFD(exifTagExifIFD, pointerType,
+			b.rational(exifTagExposureTime, 1, 250),
+			b.rational(exifTagFNumber, 28, 10),
+			b.short(exifTagISO, 400),
+			b.ascii(exifTagDateTimeOriginal, "2016:03:01 12:30:00"),
+			b.rational(exifTagFocalLength, 50, 1),
+			b.ascii(exifTagLensMake, "Canon"),
+			b.ascii(exifTagLensModel, "EF50mm f/1.8 STM"),
+		),
+		subIFD(exifTagGPSIFD, pointerType,
+			b.ascii(exifTagGPSLatitudeRef, "N"),
+			b.rational(exifTagGPSLatitude, 52, 1, 30, 1, 0, 1),
+			b.ascii(exifTagGPSLongitudeRef, "E"),
+			b.rational(exifTagGPSLongitude, 13, 1, 22, 1, 30, 1),
+		),
+	)
+}
+
+func TestParseEXIF(t *testing.T) {
+	taken := time.Date(2016, 3, 1, 12, 30, 0, 0, time.UTC)
+	camera := &ImageEXIF{
+		Make:         "Canon",
+		Model:        "Canon EOS 5D Mark III",
+		Lens:         "Canon EF50mm f/1.8 STM",
+		ExposureTime: "1/250",
+		FNumber:      2.8,
+		ISO:          400,
+		FocalLength:  50,
+		DateTaken:    &taken,
+		GPS:          &GPSPosition{Latitude: 52.5, Longitude: 13.375},
+		Orientation:  6,
+	}
+
+	le, be := newEXIFBuilder(binary.LittleEndian), newEXIFBuilder(binary.BigEndian)
+	tests := []struct {
+		name  string
+		block []byte
+		want  *ImageEXIF
+	}{
+		{"little endian", cameraEXIF(binary.LittleEndian, tiffLong), camera},
+		{"big endian", cameraEXIF(binary.BigEndian, tiffLong), camera},
+		{"sub-IFDs typed IFD", cameraEXIF(binary.BigEndian, tiffIFDType), camera},
+		{
+			"long exposure, lens make in the model",
+			be.build(subIFD(exifTagExifIFD, tiffLong,
+				be.rational(exifTagExposureTime, 5, 2),
+				be.ascii(exifTagLensMake, "Sony"),
+				be.ascii(exifTagLensModel, "Sony FE 35mm"),
+			)),
+			&ImageEXIF{ExposureTime: "2.5", Lens: "Sony FE 35mm"},
+		},
+		{
+			"south and west",
+			le.build(subIFD(exifTagGPSIFD, tiffLong,
+				le.ascii(exifTagGPSLatitudeRef, "S"),
+				le.rational(exifTagGPSLatitude, 33, 1, 52, 1, 48, 1),
+				le.ascii(exifTagGPSLongitudeRef, "W"),
+				le.rational(exifTagGPSLongitude, 70, 1, 15, 1, 0, 1),
+			)),
+			&ImageEXIF{GPS: &GPSPosition{Latitude: -(33 + 52.0/60 + 48.0/3600), Longitude: -70.25}},
+		},
+	}
+	for _, test := range tests {
+		exif, err := parseEXIF(test.block)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(exif, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, exif, test.want)
+		}
+	}
+}
+
+func TestParseEXIFIgnoresBadFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields func(b *exifBuilder) []exifField
+		want   *ImageEXIF
+	}{
+		{
+			"orientation out of range",
+			func(b *exifBuilder) []exifField {
+				return []exifField{b.short(exifTagOrientation, 9)}
+			},
+			&ImageEXIF{},
+		},
+		{
+			"latitude beyond the pole",
+			func(b *exifBuilder) []exifField {
+				return []exifField{subIFD(exifTagGPSIFD, tiffLong,
+					b.rational(exifTagGPSLatitude, 95, 1, 0, 1, 0, 1),
+					b.rational(exifTagGPSLongitude, 13, 1, 0, 1, 0, 1),
+				)}
+			},
+			&ImageEXIF{},
+		},
+		{
+			"latitude without minutes and seconds",
+			func(b *exifBuilder) []exifField {
+				return []exifField{subIFD(exifTagGPSIFD, tiffLong,
+					b.rational(exifTagGPSLatitude, 52, 1),
+					b.rational(exifTagGPSLongitude, 13, 1, 0, 1, 0, 1),
+				)}
+			},
+			&ImageEXIF{},
+		},
+		{
+			"zero denominator",
+			func(b *exifBuilder) []exifField {
+				return []exifField{subIFD(exifTagExifIFD, tiffLong,
+					b.rational(exifTagFNumber, 28, 0),
+					b.short(exifTagISO, 100),
+				)}
+			},
+			&ImageEXIF{ISO: 100},
+		},
+		{
+			"date in another format",
+			func(b *exifBuilder) []exifField {
+				return []exifField{subIFD(exifTagExifIFD, tiffLong,
+					b.ascii(exifTagDateTimeOriginal, "2016-03-01T12:30:00"),
+				)}
+			},
+			&ImageEXIF{},
+		},
+		{
+			"make of the wrong type",
+			func(b *exifBuilder) []exifField {
+				return []exifField{b.short(exifTagMake, 1), b.undefined(exifTagModel, "EOS\x00")}
+			},
+			&ImageEXIF{Model: "EOS"},
+		},
+		{
+			"sub-IFD out of range",
+			func(b *exifBuilder) []exifField {
+				pointer := exifField{Tag: exifTagGPSIFD, Type: tiffLong, Count: 1, Value: []byte{0, 0, 0xFF, 0xFF}}
+				return []exifField{b.ascii(exifTagMake, "Canon"), pointer}
+			},
+			&ImageEXIF{Make: "Canon"},
+		},
+	}
+	for _, test := range tests {
+		b := newEXIFBuilder(binary.BigEndian)
+		exif, err := parseEXIF(b.build(test.fields(b)...))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(exif, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, exif, test.want)
+		}
+	}
+}
+
+func TestParseEXIFInvalid(t *testing.T) {
+	valid := cameraEXIF(binary.BigEndian, tiffLong)
+	tooManyEntries := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint16(tooManyEntries[8:], tiffMaxEntries+1)
+
+	tests := []struct {
+		name  string
+		block []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("MM\x00\x2a")},
+		{"unknown byte order", append([]byte("XX"), valid[2:]...)},
+		{"wrong magic number", append([]byte("MM\x00\x2b"), valid[4:]...)},
+		{"first IFD out of range", []byte("MM\x00\x2a\x00\x00\x10\x00")},
+		{"cut off in the first IFD", valid[:20]},
+		{"too many entries", tooManyEntries},
+	}
+	for _, test := range tests {
+		if exif, err := parseEXIF(test.block); err == nil {
+			t.Errorf("%s: got %+v, want an error", test.name, exif)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	fetchMaxRedirects   = 5
+	fetchConnectTimeout = 10 * time.Second
+	// How long a download may go without a byte coming in, and how long it
+	// may take in all
+	fetchReadTimeout = 30 * time.Second
+	fetchTimeout     = 2 * time.Minute
+)
+
+// Images are never fetched from these, so users can't make the server reach
+// itself, its network or the metadata services of cloud hosts.
+var fetchBlockedNetworks = parseNetworks(
+	"0.0.0.0/8",          // this network
+	"10.0.0.0/8",         // private
+	"100.64.0.0/10",      // carrier-grade NAT
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local, where metadata services live
+	"172.16.0.0/12",      // private
+	"192.0.0.0/24",       // protocol assignments
+	"192.0.2.0/24",       // documentation
+	"192.168.0.0/16",     // private
+	"198.18.0.0/15",      // benchmarking
+	"198.51.100.0/24",    // documentation
+	"203.0.113.0/24",     // documentation
+	"224.0.0.0/4",        // multicast
+	"240.0.0.0/4",        // reserved
+	"255.255.255.255/32", // broadcast
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"64:ff9b::/96",       // NAT64, which embeds any IPv4 address
+	"100::/64",           // discard
+	"2001::/32",          // Teredo, which embeds one too
+	"2001:db8::/32",      // documentation
+	"2002::/16",          // 6to4, which embeds one as well
+	"fc00::/7",           // unique local
+	"fe80::/10",          // link-local
+	"ff00::/8",           // multicast
+)
+
+var errFetchRedirects = errors.New("too many redirects")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(fmt.Errorf("Invalid network %q: %s", cidr, err))
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// fetchAllowedIP reports whether images may be fetched from ip.
+func fetchAllowedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range fetchBlockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// imageFetch is a single download of a remote image.
+type imageFetch struct {
+	// Set once a connection to a blocked address was refused
+	blocked bool
+}
+
+// FetchImage starts downloading the image at rawurl, and returns the body
+// for the caller to read and close. Only public addresses are connected to,
+// which is checked for every redirect, and connecting, waiting and the
+// download as a whole time out. Servers announcing a file larger than
+// config.UploadMaxSize are turned down straight away. What the server says
+// the type of the file is isn't trusted, the caller tells from the contents.
+func FetchImage(rawurl string) (io.ReadCloser, error) {
+	target, err := url.Parse(rawurl)
+	if err != nil || !fetchableURL(target) {
+		return nil, errImageURLInvalid
+	}
+
+	fetch := &imageFetch{}
+	client := &http.Client{
+		// No proxy, which would connect on our behalf unchecked
+		Transport: &http.Transport{
+			Dial:                  fetch.dial,
+			TLSHandshakeTimeout:   fetchConnectTimeout,
+			ResponseHeaderTimeout: fetchReadTimeout,
+			DisableKeepAlives:     true,
+		},
+		CheckRedirect: checkFetchRedirect,
+		Timeout:       fetchTimeout,
+	}
+	request, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, errImageURLInvalid
+	}
+	request.Header.Set("Accept", "image/*")
+
+	response, err := client.Do(request)
+	if err != nil {
+		if fetch.blocked {
+			return nil, errImageURLForbidden
+		}
+		return nil, errImageURLInvalid
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, errImageURLInvalid
+	}
+	if response.ContentLength > config.UploadMaxSize {
+		response.Body.Close()
+		return nil, errImageTooLarge
+	}
+	return response.Body, nil
+}
+
+func fetchableURL(target *url.URL) bool {
+	return (target.Scheme == "http" || target.Scheme == "https") && target.Host != "" && target.User == nil
+}
+
+// checkFetchRedirect follows a limited number of redirects, and only to
+// web URLs. Where they lead is checked when connecting.
+func checkFetchRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= fetchMaxRedirects {
+		return errFetchRedirects
+	}
+	if !fetchableURL(request.URL) {
+		return errImageURLInvalid
+	}
+	return nil
+}
+
+// dial resolves the host and connects to one of its addresses, refusing if
+// any of them is blocked. The address checked is the one connected to, so
+// a second lookup can't give another.
+func (fetch *imageFetch) dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !fetchAllowedIP(ip) {
+			fetch.blocked = true
+			return nil, errImageURLForbidden
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: fetchConnectTimeout}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return &fetchConn{conn}, nil
+		}
+	}
+	return nil, err
+}
+
+// fetchConn gives up on a server that stops sending.
+type fetchConn struct {
+	net.Conn
+}
+
+func (conn *fetchConn) Read(p []byte) (int, error) {
+	err := conn.Conn.SetReadDeadline(time.Now().Add(fetchReadTimeout))
+	if err != nil {
+		return 0, err
+	}
+	return conn.Conn.Read(p)
+}
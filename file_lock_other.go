@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// lockFileExclusive is a no-op where flock isn't available, so running two
+// processes against the same store file is not detected there.
+func lockFileExclusive(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import "testing"
+
+func TestFileStoreLocked(t *testing.T) {
+	filename, cleanup := tempStoreFile(t)
+	defer cleanup()
+
+	data := map[string]string{}
+	store, err := NewFileStore(filename, &data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flock locks belong to the open file, so this conflicts even from
+	// within the same process
+	_, err = NewFileStore(filename, &data, nil)
+	if err == nil {
+		t.Fatal("opened a store that is already open")
+	}
+
+	store.Close()
+	store, err = NewFileStore(filename, &data, nil)
+	if err != nil {
+		t.Fatalf("opening the store after closing it: %s", err)
+	}
+	store.Close()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps a value as indented JSON in a single file. It is shared by
+// the file based user and session stores.
+//
+// The embedded RWMutex guards the value, and callers take it around both
+// reads and changes. The file is replaced atomically on every write, and an
+// advisory lock stops a second process from opening the same store.
+//
+// In journal mode changes are appended to a log next to the file instead,
+// see file_store_journal.go.
+type FileStore struct {
+	sync.RWMutex
+	filename string
+	data     interface{}
+	lockFile *os.File
+
+	apply       JournalFunc
+	journal     *os.File
+	journalSize int64
+	compacting  bool
+}
+
+// CorruptFileError is returned when a store file exists but doesn't hold
+// valid JSON, usually because it was cut short. The file is left untouched so
+// it can be inspected or restored.
+type CorruptFileError struct {
+	Filename string
+	Err      error
+}
+
+func (err *CorruptFileError) Error() string {
+	return fmt.Sprintf("%s is corrupt: %s", err.Filename, err.Err)
+}
+
+// NewFileStore locks filename and loads its contents into data, which must be
+// a pointer. A missing file is fine, data is then left as it is.
+//
+// If apply is given the store runs in journal mode, and apply is used to
+// replay the journal on top of what was loaded.
+func NewFileStore(filename string, data interface{}, apply JournalFunc) (*FileStore, error) {
+	store := &FileStore{
+		filename: filename,
+		data:     data,
+		apply:    apply,
+	}
+
+	lockFile, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFileExclusive(lockFile)
+	if err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("%s is in use by another process: %s", filename, err)
+	}
+	store.lockFile = lockFile
+
+	err = store.load()
+	if err == nil && store.apply != nil {
+		err = store.openJournal()
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *FileStore) load() error {
+	contents, err := ioutil.ReadFile(store.filename)
+	if err != nil {
+		// If it's a matter of the file not existing, that's ok
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// A crash used to be able to leave an empty file behind
+	if len(bytes.TrimSpace(contents)) == 0 {
+		return &CorruptFileError{store.filename, fmt.Errorf("file is empty")}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	err = decoder.Decode(store.data)
+	if err != nil {
+		return &CorruptFileError{store.filename, err}
+	}
+	// Anything after the value means two writes got mixed up
+	if _, err := decoder.Token(); err != io.EOF {
+		return &CorruptFileError{store.filename, fmt.Errorf("unexpected data after JSON value")}
+	}
+	return nil
+}
+
+// Record persists a change that has already been made to the value. Callers
+// must hold the write lock. In journal mode only the change is written,
+// otherwise the whole value is.
+func (store *FileStore) Record(op, key string, value interface{}) error {
+	if store.apply != nil {
+		return store.appendJournal(JournalRecord{Op: op, Key: key}, value)
+	}
+	return store.Write()
+}
+
+// Write saves the current value. Callers must hold the write lock.
+//
+// The value is written to a temporary file that is synced and then renamed
+// over the old one, so a crash leaves either the old or the new contents.
+func (store *FileStore) Write() error {
+	contents, err := json.MarshalIndent(store.data, "", "   ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.filename, contents, 0660)
+}
+
+// Close closes the journal and releases the lock on the store file.
+func (store *FileStore) Close() error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.journal != nil {
+		store.journal.Close()
+		store.journal = nil
+	}
+	if store.lockFile == nil {
+		return nil
+	}
+	err := store.lockFile.Close()
+	store.lockFile = nil
+	return err
+}
+
+func writeFileAtomic(filename string, contents []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	tempFile, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	// Clean up if anything below fails, this is a no-op after the rename
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(contents)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tempFile.Name(), perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempFile.Name(), filename)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the rename itself survives a crash. Not every platform can
+	// sync a directory, so failures here are ignored.
+	if dirFile, err := os.Open(dir); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Journal operations used by the file based stores
+const (
+	journalSave   = "save"
+	journalDelete = "delete"
+)
+
+// JournalRecord is a single change in the journal of a FileStore. Each one is
+// written as a line of JSON.
+type JournalRecord struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JournalFunc applies a journal record to the value of a FileStore.
+type JournalFunc func(record JournalRecord) error
+
+func (store *FileStore) journalName() string {
+	return store.filename + ".journal"
+}
+
+// openJournal replays any journal left over from an interrupted compaction
+// and then the current journal, and opens the latter for appending.
+func (store *FileStore) openJournal() error {
+	err := store.replayJournal(store.journalName() + ".old")
+	if err != nil {
+		return err
+	}
+	err = store.replayJournal(store.journalName())
+	if err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(store.journalName(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+	info, err := journal.Stat()
+	if err != nil {
+		journal.Close()
+		return err
+	}
+	store.journal = journal
+	store.journalSize = info.Size()
+	store.maybeCompact()
+	return nil
+}
+
+func (store *FileStore) replayJournal(name string) error {
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	offset := 0
+	for line := 1; offset < len(contents); line++ {
+		end := bytes.IndexByte(contents[offset:], '\n')
+		if end < 0 {
+			// The last append never finished, so it was never reported as
+			// saved either. Drop it so new records start on a clean line.
+			log.Printf("Dropping incomplete record at the end of %s", name)
+			return os.Truncate(name, int64(offset))
+		}
+
+		record := JournalRecord{}
+		err = json.Unmarshal(contents[offset:offset+end], &record)
+		if err == nil {
+			err = store.apply(record)
+		}
+		if err != nil {
+			return &CorruptFileError{name, fmt.Errorf("line %d: %s", line, err)}
+		}
+		offset += end + 1
+	}
+	return nil
+}
+
+// appendJournal writes record, with value as its payload, to the end of the
+// journal. Callers must hold the write lock.
+func (store *FileStore) appendJournal(record JournalRecord, value interface{}) error {
+	if store.journal == nil {
+		return fmt.Errorf("%s is closed", store.filename)
+	}
+
+	var err error
+	if value != nil {
+		record.Value, err = json.Marshal(value)
+		if err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	n, err := store.journal.Write(line)
+	if err == nil {
+		err = store.journal.Sync()
+	}
+	if err != nil {
+		// Don't leave half a record for the next one to be appended to
+		store.journal.Truncate(store.journalSize)
+		return err
+	}
+	store.journalSize += int64(n)
+	store.maybeCompact()
+	return nil
+}
+
+// maybeCompact starts a compaction in the background once the journal has
+// grown past the configured size. Callers must hold the write lock.
+func (store *FileStore) maybeCompact() {
+	if store.compacting || store.journalSize < config.FileStoreCompactSize {
+		return
+	}
+	store.compacting = true
+	go func() {
+		err := store.compact()
+		if err != nil {
+			log.Printf("Error compacting %s: %s", store.filename, err)
+		}
+	}()
+}
+
+// compact folds the journal into a new snapshot.
+//
+// The journal is moved aside while the lock is held, so changes carry on in a
+// fresh journal while the snapshot is written. The old journal is only
+// removed once the snapshot is safely on disk.
+func (store *FileStore) compact() error {
+	oldName := store.journalName() + ".old"
+
+	store.Lock()
+	defer func() {
+		store.Lock()
+		store.compacting = false
+		store.Unlock()
+	}()
+
+	if store.journal == nil {
+		store.Unlock()
+		return nil
+	}
+
+	contents, err := json.MarshalIndent(store.data, "", "   ")
+	if err != nil {
+		store.Unlock()
+		return err
+	}
+
+	// An earlier compaction failed half way. Finish both while we hold
+	// the lock rather than juggle two old journals.
+	if _, err := os.Stat(oldName); err == nil {
+		err = writeFileAtomic(store.filename, contents, 0660)
+		if err == nil {
+			err = os.Remove(oldName)
+		}
+		if err == nil {
+			err = store.journal.Truncate(0)
+		}
+		if err == nil {
+			store.journalSize = 0
+		}
+		store.Unlock()
+		return err
+	}
+
+	err = store.rotateJournal(oldName)
+	store.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(store.filename, contents, 0660)
+	if err != nil {
+		return err
+	}
+	return os.Remove(oldName)
+}
+
+// rotateJournal moves the journal to oldName and starts an empty one. Callers
+// must hold the write lock.
+func (store *FileStore) rotateJournal(oldName string) error {
+	err := store.journal.Close()
+	if err != nil {
+		return err
+	}
+	store.journal = nil
+
+	// Whatever happens with the rename, keep a journal open to append to
+	renameErr := os.Rename(store.journalName(), oldName)
+
+	journal, err := os.OpenFile(store.journalName(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+	store.journal = journal
+	if renameErr != nil {
+		return renameErr
+	}
+	store.journalSize = 0
+	return nil
+}
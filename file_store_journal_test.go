@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// openJournalStore opens a journaled store of strings, as the user and
+// session stores keep their values.
+func openJournalStore(filename string) (*FileStore, map[string]string, error) {
+	data := map[string]string{}
+	apply := func(record JournalRecord) error {
+		switch record.Op {
+		case journalSave:
+			var value string
+			err := json.Unmarshal(record.Value, &value)
+			if err != nil {
+				return err
+			}
+			data[record.Key] = value
+		case journalDelete:
+			delete(data, record.Key)
+		default:
+			return fmt.Errorf("unknown journal operation %q", record.Op)
+		}
+		return nil
+	}
+	store, err := NewFileStore(filename, &data, apply)
+	return store, data, err
+}
+
+func TestFileStoreJournalReplay(t *testing.T) {
+	save1 := `{"op":"save","key":"usr_1","value":"gopher"}` + "\n"
+	save2 := `{"op":"save","key":"usr_2","value":"mole"}` + "\n"
+	delete1 := `{"op":"delete","key":"usr_1"}` + "\n"
+
+	tests := []struct {
+		name     string
+		snapshot string
+		journal  string
+		old      string // left over from a compaction that didn't finish
+		want     map[string]string
+		corrupt  bool
+		// What is left of the journal once it's replayed
+		wantJournal string
+	}{
+		{
+			name: "nothing",
+			want: map[string]string{},
+		},
+		{
+			name:        "saves",
+			journal:     save1 + save2,
+			want:        map[string]string{"usr_1": "gopher", "usr_2": "mole"},
+			wantJournal: save1 + save2,
+		},
+		{
+			name:        "on top of the snapshot",
+			snapshot:    `{"usr_1": "gopher"}`,
+			journal:     save2 + delete1,
+			want:        map[string]string{"usr_2": "mole"},
+			wantJournal: save2 + delete1,
+		},
+		{
+			name:        "torn last line",
+			journal:     save1 + `{"op":"save","key":"usr_2","val`,
+			want:        map[string]string{"usr_1": "gopher"},
+			wantJournal: save1,
+		},
+		{
+			name:        "torn only line",
+			journal:     `{"op":"sa`,
+			want:        map[string]string{},
+			wantJournal: "",
+		},
+		{
+			name:        "old journal first",
+			old:         save1 + save2,
+			journal:     delete1,
+			want:        map[string]string{"usr_2": "mole"},
+			wantJournal: delete1,
+		},
+		{
+			name:    "broken line in the middle",
+			journal: save1 + "{not json}\n" + save2,
+			corrupt: true,
+		},
+		{
+			name:    "unknown operation",
+			journal: `{"op":"rename","key":"usr_1"}` + "\n",
+			corrupt: true,
+		},
+	}
+	for _, test := range tests {
+		filename, cleanup := tempStoreFile(t)
+		files := map[string]string{
+			filename:                  test.snapshot,
+			filename + ".journal":     test.journal,
+			filename + ".journal.old": test.old,
+		}
+		for name, contents := range files {
+			if contents == "" {
+				continue
+			}
+			err := ioutil.WriteFile(name, []byte(contents), 0660)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		store, data, err := openJournalStore(filename)
+		if test.corrupt {
+			if _, ok := err.(*CorruptFileError); !ok {
+				t.Errorf("%s: error = %v, want a CorruptFileError", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else {
+			if !reflect.DeepEqual(data, test.want) {
+				t.Errorf("%s: replayed %v, want %v", test.name, data, test.want)
+			}
+			journal, _ := ioutil.ReadFile(filename + ".journal")
+			if string(journal) != test.wantJournal {
+				t.Errorf("%s: journal is %q, want %q", test.name, journal, test.wantJournal)
+			}
+		}
+		if store != nil {
+			store.Close()
+		}
+		cleanup()
+	}
+}
+
+// recordSave saves value under key in a store opened by openJournalStore.
+func recordSave(t *testing.T, store *FileStore, data map[string]string, key, value string) {
+	store.Lock()
+	defer store.Unlock()
+	data[key] = value
+	err := store.Record(journalSave, key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	filename, cleanup := tempStoreFile(t)
+	defer cleanup()
+
+	// Compacted by hand below, rather than in the background
+	defer func(size int64) { config.FileStoreCompactSize = size }(config.FileStoreCompactSize)
+	config.FileStoreCompactSize = 1 << 30
+
+	store, data, err := openJournalStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSave(t, store, data, "usr_1", "gopher")
+	recordSave(t, store, data, "usr_2", "mole")
+
+	err = store.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := map[string]string{}
+	contents, _ := ioutil.ReadFile(filename)
+	err = json.Unmarshal(contents, &snapshot)
+	if err != nil || !reflect.DeepEqual(snapshot, data) {
+		t.Errorf("snapshot after compacting = %v (%v), want %v", snapshot, err, data)
+	}
+	if info, err := os.Stat(filename + ".journal"); err != nil || info.Size() != 0 {
+		t.Errorf("journal after compacting = %v (%v), want it empty", info, err)
+	}
+	if _, err := os.Stat(filename + ".journal.old"); !os.IsNotExist(err) {
+		t.Errorf("old journal is still there after compacting (%v)", err)
+	}
+
+	// Changes after compacting go to the new journal, on top of the snapshot
+	recordSave(t, store, data, "usr_3", "vole")
+	store.Close()
+
+	reopened, replayed, err := openJournalStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	want := map[string]string{"usr_1": "gopher", "usr_2": "mole", "usr_3": "vole"}
+	if !reflect.DeepEqual(replayed, want) {
+		t.Errorf("reopened with %v, want %v", replayed, want)
+	}
+}
+
+func TestFileStoreCompactFinishesEarlierCompaction(t *testing.T) {
+	filename, cleanup := tempStoreFile(t)
+	defer cleanup()
+
+	defer func(size int64) { config.FileStoreCompactSize = size }(config.FileStoreCompactSize)
+	config.FileStoreCompactSize = 1 << 30
+
+	// As a crash between moving the journal aside and writing the
+	// snapshot leaves it
+	old := `{"op":"save","key":"usr_1","value":"gopher"}` + "\n"
+	err := ioutil.WriteFile(filename+".journal.old", []byte(old), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, data, err := openJournalStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	recordSave(t, store, data, "usr_2", "mole")
+
+	err = store.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := map[string]string{}
+	contents, _ := ioutil.ReadFile(filename)
+	err = json.Unmarshal(contents, &snapshot)
+	want := map[string]string{"usr_1": "gopher", "usr_2": "mole"}
+	if err != nil || !reflect.DeepEqual(snapshot, want) {
+		t.Errorf("snapshot after compacting = %v (%v), want %v", snapshot, err, want)
+	}
+	if _, err := os.Stat(filename + ".journal.old"); !os.IsNotExist(err) {
+		t.Errorf("old journal is still there after compacting (%v)", err)
+	}
+	if info, err := os.Stat(filename + ".journal"); err != nil || info.Size() != 0 {
+		t.Errorf("journal after compacting = %v (%v), want it empty", info, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tempStoreFile returns the name of a store file in a new directory, and a
+// function that removes the directory again.
+func tempStoreFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gophr-file-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "store.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestFileStoreWriteAndLoad(t *testing.T) {
+	filename, cleanup := tempStoreFile(t)
+	defer cleanup()
+
+	data := map[string]string{}
+	store, err := NewFileStore(filename, &data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Lock()
+	data["usr_1"] = "gopher"
+	err = store.Record(journalSave, "usr_1", "gopher")
+	store.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	loaded := map[string]string{}
+	store, err = NewFileStore(filename, &loaded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if !reflect.DeepEqual(loaded, data) {
+		t.Errorf("loaded %v, want %v", loaded, data)
+	}
+}
+
+func TestFileStoreLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     map[string]string
+		corrupt  bool
+	}{
+		{"valid", `{"usr_1": "gopher"}`, map[string]string{"usr_1": "gopher"}, false},
+		{"trailing newline", "{\"usr_1\": \"gopher\"}\n", map[string]string{"usr_1": "gopher"}, false},
+		{"empty", "", nil, true},
+		{"blank", " \n ", nil, true},
+		{"cut short", `{"usr_1": "gop`, nil, true},
+		{"two values", `{"usr_1": "gopher"}{"usr_2": "gopher"}`, nil, true},
+		{"wrong type", `["gopher"]`, nil, true},
+	}
+	for _, test := range tests {
+		filename, cleanup := tempStoreFile(t)
+		err := ioutil.WriteFile(filename, []byte(test.contents), 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := map[string]string{}
+		store, err := NewFileStore(filename, &data, nil)
+		if test.corrupt {
+			if _, ok := err.(*CorruptFileError); !ok {
+				t.Errorf("%s: error = %v, want a CorruptFileError", test.name, err)
+			}
+			// The file is kept for whoever has to sort it out
+			if contents, _ := ioutil.ReadFile(filename); string(contents) != test.contents {
+				t.Errorf("%s: file changed to %q", test.name, contents)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			} else if !reflect.DeepEqual(data, test.want) {
+				t.Errorf("%s: loaded %v, want %v", test.name, data, test.want)
+			}
+		}
+		if store != nil {
+			store.Close()
+		}
+		cleanup()
+	}
+}
+
+func TestFileStoreMissingFile(t *testing.T) {
+	filename, cleanup := tempStoreFile(t)
+	defer cleanup()
+
+	data := map[string]string{"usr_1": "gopher"}
+	store, err := NewFileStore(filename, &data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if len(data) != 1 {
+		t.Errorf("data = %v, want it left as it was", data)
+	}
+}
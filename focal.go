@@ -0,0 +1,146 @@
+package main
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// focusSampleSize is the size of the copy the automatic focal point is
+// found on, in pixels a side
+const focusSampleSize = 64
+
+// FocalPoint is the part of an image crops keep in view, as fractions of
+// the width and height of the image as it's shown, from its top left.
+type FocalPoint struct {
+	X float64 `bson:"x"`
+	Y float64 `bson:"y"`
+}
+
+var centerFocus = FocalPoint{0.5, 0.5}
+
+func (point *FocalPoint) Validate() error {
+	if point.X < 0 || point.X > 1 || point.Y < 0 || point.Y > 1 {
+		return errInvalidFocalPoint
+	}
+	return nil
+}
+
+// XPercent and YPercent give the point in percent, as the editor shows it.
+func (point *FocalPoint) XPercent() int {
+	return int(point.X*100 + 0.5)
+}
+
+func (point *FocalPoint) YPercent() int {
+	return int(point.Y*100 + 0.5)
+}
+
+// focus returns the focal point crops of srcImage, the image as it's
+// shown, keep in view. That's the one the owner set, or else the busiest
+// part of the picture.
+func (image *Image) focus(srcImage image.Image) FocalPoint {
+	if image.FocalPoint != nil {
+		return *image.FocalPoint
+	}
+	return AutoFocalPoint(srcImage)
+}
+
+// AutoFocalPoint finds the centre of the edge energy of img: the middle of
+// where brightness changes most, which is where the subject tends to be,
+// rather than on plain sky or background.
+func AutoFocalPoint(img image.Image) FocalPoint {
+	small := imaging.Fit(img, focusSampleSize, focusSampleSize, imaging.Box)
+	width, height := small.Bounds().Dx(), small.Bounds().Dy()
+	if width < 3 || height < 3 {
+		return centerFocus
+	}
+
+	var sumX, sumY, total float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			dx := luminance(small, x+1, y) - luminance(small, x-1, y)
+			dy := luminance(small, x, y+1) - luminance(small, x, y-1)
+			// Squared, so a few strong edges outweigh lots of faint
+			// texture
+			energy := dx*dx + dy*dy
+			sumX += energy * (float64(x) + 0.5)
+			sumY += energy * (float64(y) + 0.5)
+			total += energy
+		}
+	}
+	if total == 0 {
+		return centerFocus
+	}
+	return FocalPoint{sumX / total / float64(width), sumY / total / float64(height)}
+}
+
+// rotate moves the point along with an image rotated by degrees
+// counter-clockwise, as imaging.Rotate90 and friends do.
+func (point FocalPoint) rotate(degrees int) FocalPoint {
+	switch degrees {
+	case 90:
+		return FocalPoint{point.Y, 1 - point.X}
+	case 180:
+		return FocalPoint{1 - point.X, 1 - point.Y}
+	case 270:
+		return FocalPoint{1 - point.Y, point.X}
+	}
+	return point
+}
+
+// flip moves the point along with an image flipped horizontally ("h") or
+// vertically ("v").
+func (point FocalPoint) flip(direction string) FocalPoint {
+	switch direction {
+	case "h":
+		return FocalPoint{1 - point.X, point.Y}
+	case "v":
+		return FocalPoint{point.X, 1 - point.Y}
+	}
+	return point
+}
+
+// focusWindow returns the width by height part of bounds centred as near
+// focus as it fits.
+func focusWindow(bounds image.Rectangle, width, height int, focus FocalPoint) image.Rectangle {
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if width > srcWidth {
+		width = srcWidth
+	}
+	if height > srcHeight {
+		height = srcHeight
+	}
+
+	x := clampInt(int(focus.X*float64(srcWidth)+0.5)-width/2, 0, srcWidth-width)
+	y := clampInt(int(focus.Y*float64(srcHeight)+0.5)-height/2, 0, srcHeight-height)
+	return image.Rect(x, y, x+width, y+height).Add(bounds.Min)
+}
+
+// focusFill returns the largest part of bounds with the aspect ratio of
+// width by height, centred as near focus as it fits.
+func focusFill(bounds image.Rectangle, width, height int, focus FocalPoint) image.Rectangle {
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	cropWidth, cropHeight := srcWidth, srcHeight
+	if srcWidth*height > srcHeight*width {
+		cropWidth = int(float64(srcHeight)*float64(width)/float64(height) + 0.5)
+	} else {
+		cropHeight = int(float64(srcWidth)*float64(height)/float64(width) + 0.5)
+	}
+	if cropWidth < 1 {
+		cropWidth = 1
+	}
+	if cropHeight < 1 {
+		cropHeight = 1
+	}
+	return focusWindow(bounds, cropWidth, cropHeight, focus)
+}
+
+func clampInt(value, min, max int) int {
+	if value > max {
+		value = max
+	}
+	if value < min {
+		value = min
+	}
+	return value
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -11,7 +18,17 @@ func HandleImageNew(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	RenderTemplate(w, r, "images/new", nil)
 }
 
+// uploadFormOverhead is how much larger than the file an upload form may be,
+// for the other fields and the multipart framing.
+const uploadFormOverhead = 1 << 20
+
 func HandleImageCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Reading the form reads the whole body, so it's limited before that
+	body := &uploadBody{
+		ReadCloser: http.MaxBytesReader(w, r.Body, config.UploadMaxSize+uploadFormOverhead),
+		limit:      config.UploadMaxSize + uploadFormOverhead,
+	}
+	r.Body = body
 	if r.FormValue("url") != "" {
 		HandleImageCreateFromURL(w, r)
 		return
@@ -25,6 +42,9 @@ func HandleImageCreateFromURL(w http.ResponseWriter, r *http.Request) {
 
 	image := NewImage(user)
 	image.Description = r.FormValue("description")
+	if r.FormValue("allowDuplicate") == "1" {
+		image.AllowDuplicate()
+	}
 
 	err := image.CreatedFromURL(r.FormValue("url"))
 	if err != nil {
@@ -47,32 +67,41 @@ func HandleImageCreateFromFile(w http.ResponseWriter, r *http.Request) {
 	image := NewImage(user)
 
 	image.Description = r.FormValue("description")
+	if r.FormValue("allowDuplicate") == "1" {
+		image.AllowDuplicate()
+	}
 
 	file, headers, err := r.FormFile("file")
-
-	// No file was uploaded.
-	if file == nil {
+	if err != nil {
+		switch {
+		// No file was uploaded.
+		case err == http.ErrMissingFile:
+			err = errNoImage
+		case r.Body.(*uploadBody).tooLarge:
+			err = errImageTooLarge
+		// A file was uploaded, but it didn't arrive whole
+		default:
+			err = errUploadFailed
+		}
 		RenderTemplate(w, r, "images/new", map[string]interface{}{
-			"Error": errNoImage,
+			"Error": err,
 			"Image": image,
 		})
 		return
 	}
 
-	// A file was uploaded, but an error occurred
-	if err != nil {
-		panic(err)
-	}
-
 	defer file.Close()
 
 	err = image.CreatedFromFile(file, headers)
 	if err != nil {
-		RenderTemplate(w, r, "images/new", map[string]interface{}{
-			"Error": err,
-			"Image": image,
-		})
-		return
+		if IsValidationError(err) {
+			RenderTemplate(w, r, "images/new", map[string]interface{}{
+				"Error": err,
+				"Image": image,
+			})
+			return
+		}
+		panic(err)
 	}
 	http.Redirect(w, r, "/?flash=Image+Uploaded+Successfully", http.StatusFound)
 }
@@ -85,8 +114,8 @@ func HandleImageShow(w http.ResponseWriter, r *http.Request, params httprouter.P
 		return
 	}
 
-	// 404
-	if image == nil {
+	// 404, images in the trash are only listed on the owner's trash page
+	if image == nil || image.InTrash() {
 		return
 	}
 
@@ -99,8 +128,295 @@ func HandleImageShow(w http.ResponseWriter, r *http.Request, params httprouter.P
 		panic(fmt.Errorf("Couldn't find user %s", image.UserID))
 	}
 
+	similar, err := db.FindSimilar(image, similarImageLimit)
+	if err != nil {
+		panic(err)
+	}
+
 	RenderTemplate(w, r, "images/show", map[string]interface{}{
+		"Image":        image,
+		"User":         user,
+		"ShowLocation": image.ShowLocation(user),
+		"Similar":      similar,
+	})
+}
+
+func HandleImageEdit(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+	RenderTemplate(w, r, "images/edit", map[string]interface{}{
 		"Image": image,
-		"User":  user,
 	})
 }
+
+func HandleImageUpdate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+
+	image.Name = r.FormValue("name")
+	image.Description = r.FormValue("description")
+	if image.Name == "" {
+		RenderTemplate(w, r, "images/edit", map[string]interface{}{
+			"Error": errNoImageTitle,
+			"Image": image,
+		})
+		return
+	}
+
+	err := image.UpdateDetails()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, image.ShowRoute()+"?flash=Image+updated", http.StatusFound)
+}
+
+func HandleImageDestroy(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+
+	err := image.Trash()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, RequestUser(r).ImagesRoute()+"?flash=Image+moved+to+trash", http.StatusFound)
+}
+
+func HandleImageRestore(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+
+	err := image.Restore()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, image.ShowRoute()+"?flash=Image+restored", http.StatusFound)
+}
+
+func HandleImagePurge(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+	// Only what's in the trash can be deleted for good
+	if !image.InTrash() {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := image.Delete()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, "/trash?flash=Image+deleted+for+good", http.StatusFound)
+}
+
+func HandleTrash(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	db := NewDBImageStore()
+	defer db.Close()
+	images, err := db.FindTrashByUser(RequestUser(r))
+	if err != nil {
+		panic(err)
+	}
+
+	RenderTemplate(w, r, "images/trash", map[string]interface{}{
+		"Images":        images,
+		"RetentionDays": int(config.TrashRetention.Hours() / 24),
+	})
+}
+
+// RequireImageOwner returns the image named in the URL if it belongs to the
+// current user. Otherwise it answers with a 404 or 403 and returns nil.
+func RequireImageOwner(w http.ResponseWriter, r *http.Request, params httprouter.Params) *Image {
+	db := NewDBImageStore()
+	defer db.Close()
+	image, err := db.Find(params.ByName("imageID"))
+	if err != nil {
+		panic(err)
+	}
+
+	if image == nil {
+		w.WriteHeader(http.StatusNotFound)
+		RenderTemplate(w, r, "index/404", nil)
+		return nil
+	}
+
+	user := RequestUser(r)
+	if user == nil || image.UserID != user.ID {
+		w.WriteHeader(http.StatusForbidden)
+		RenderTemplate(w, r, "index/403", nil)
+		return nil
+	}
+	return image
+}
+
+func HandleImageFile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	name := params.ByName("filepath")
+
+	// /im/img_123/w_640,h_480.jpg asks for a transformation of an image.
+	// httprouter can't have that route next to the catch-all, so it's
+	// told apart here.
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if len(parts) == 2 && strings.HasPrefix(parts[0], "img_") {
+		HandleImageTransform(w, r, parts[0], parts[1])
+		return
+	}
+
+	// Chunks of resumable uploads are the uploader's alone, and the files of
+	// images in the trash aren't shown any more than the images are
+	if IsUploadBlob(name) {
+		http.NotFound(w, r)
+		return
+	}
+	db := NewDBImageStore()
+	shown, err := db.BlobShown(name)
+	db.Close()
+	if err != nil {
+		panic(err)
+	}
+	if !shown {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Originals may carry metadata their owners don't want served
+	if IsOriginalBlob(name) {
+		db := NewDBImageStore()
+		policy, err := db.OriginalMetadataPolicy(strings.TrimPrefix(name, "/"))
+		db.Close()
+		if err != nil {
+			panic(err)
+		}
+		if NeedsStripping(name, policy) {
+			HandleStrippedImageFile(w, r, name, policy)
+			return
+		}
+	}
+
+	// Let the browser fetch the file from the blob store itself if we can
+	if urler, ok := globalBlobStore.(BlobURLer); ok && config.ImageServing == "redirect" {
+		url, err := urler.URL(name, config.ImageRedirectExpiry)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	blob, info, err := globalBlobStore.Get(name)
+	if err == errBlobNotFound {
+		// Answer here, otherwise the request falls through to RequireLogin
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	defer blob.Close()
+
+	http.ServeContent(w, r, info.Name, info.ModTime, blob)
+}
+
+// HandleStrippedImageFile serves a JPEG, TIFF or PNG original without the
+// metadata its owners' policy rules out. The stripped copy is never stored,
+// so it is always proxied.
+func HandleStrippedImageFile(w http.ResponseWriter, r *http.Request, name, policy string) {
+	blob, info, err := globalBlobStore.Get(name)
+	if err == errBlobNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	defer blob.Close()
+
+	buf := bytes.NewBuffer(nil)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tif":
+		var data []byte
+		data, err = ioutil.ReadAll(blob)
+		if err == nil {
+			data, err = StripTIFFMetadata(data, policy)
+			buf = bytes.NewBuffer(data)
+		}
+	case ".png":
+		err = StripPNGMetadata(buf, blob, policy)
+	default:
+		err = StripJPEGMetadata(buf, blob, policy)
+	}
+	if err != nil {
+		// Better no image than one with the metadata left in
+		http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		return
+	}
+	http.ServeContent(w, r, info.Name, info.ModTime, bytes.NewReader(buf.Bytes()))
+}
+
+// HandleImageTransform serves an image transformed as spec asks, from the
+// cache if it was asked for before.
+func HandleImageTransform(w http.ResponseWriter, r *http.Request, imageID, spec string) {
+	transform, err := ParseTransform(spec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db := NewDBImageStore()
+	defer db.Close()
+	image, err := db.Find(imageID)
+	if err != nil {
+		panic(err)
+	}
+	if image == nil || image.InTrash() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if file := globalTransformCache.Open(image, transform); file != nil {
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			panic(err)
+		}
+		http.ServeContent(w, r, spec, info.ModTime(), file)
+		return
+	}
+
+	contents, err := transform.Render(image)
+	if err != nil {
+		panic(err)
+	}
+	err = globalTransformCache.Put(image, transform, contents)
+	if err != nil {
+		log.Printf("Error caching %s of %s: %s", transform, image.ID, err)
+	}
+	http.ServeContent(w, r, spec, time.Now(), bytes.NewReader(contents))
+}
+
+// uploadBody is the body of an upload request, limited by
+// http.MaxBytesReader. It remembers whether the limit was hit, which the
+// errors of parsing the form don't tell.
+type uploadBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	tooLarge bool
+}
+
+func (body *uploadBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.read += int64(n)
+	if err != nil && err != io.EOF && body.read >= body.limit {
+		body.tooLarge = true
+	}
+	return n, err
+}
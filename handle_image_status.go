@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// How often the event stream checks on an image, and how long it
+	// keeps at it before the client has to reconnect
+	imageEventsInterval = time.Second
+	imageEventsTimeout  = 5 * time.Minute
+)
+
+type imageStatusJSON struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"` // processing, failed or ready
+	Attempts  int        `json:"attempts,omitempty"`
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+	Thumbnail string     `json:"thumbnail"`
+	Preview   string     `json:"preview"`
+}
+
+// findImageStatus reports how far the image with the given ID has been
+// processed, or returns nil if there's no such image to show.
+func findImageStatus(id string) (*imageStatusJSON, error) {
+	db := NewDBImageStore()
+	defer db.Close()
+	image, err := db.Find(id)
+	if err != nil || image == nil || image.InTrash() {
+		return nil, err
+	}
+
+	status := &imageStatusJSON{
+		ID:        image.ID,
+		Status:    image.Status,
+		Thumbnail: image.StaticThumbnailRoute(),
+		Preview:   image.StaticPreviewRoute(),
+	}
+	if status.Status == "" {
+		status.Status = "ready"
+	}
+	if image.Processing() {
+		job, err := globalJobQueue.Find(jobRenditions, image.Digest)
+		if err != nil {
+			return nil, err
+		}
+		// Attempts that failed, and when the next one is due
+		if job != nil && job.State == jobQueued && job.Attempts > 0 {
+			status.Attempts = job.Attempts
+			status.RetryAt = &job.RunAt
+		}
+	}
+	return status, nil
+}
+
+// HandleImageStatus answers with the processing status of an image as
+// JSON, for clients that poll.
+func HandleImageStatus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	status, err := findImageStatus(params.ByName("imageID"))
+	if err != nil {
+		panic(err)
+	}
+	if status == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = json.NewEncoder(w).Encode(status)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// HandleImageEvents streams the processing status of an image as server
+// sent events, one whenever it changes, until the image is ready or failed.
+func HandleImageEvents(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	status, err := findImageStatus(params.ByName("imageID"))
+	if err != nil {
+		panic(err)
+	}
+	if status == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	timeout := time.After(imageEventsTimeout)
+	last := ""
+	for {
+		data, err := json.Marshal(status)
+		if err != nil {
+			panic(err)
+		}
+		if string(data) != last {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			last = string(data)
+		}
+		if status.Status != imageProcessing {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			return
+		case <-time.After(imageEventsInterval):
+		}
+
+		status, err = findImageStatus(params.ByName("imageID"))
+		if err != nil {
+			// The headers are out, so all that's left is to stop
+			log.Printf("Error streaming status of image %s: %s", params.ByName("imageID"), err)
+			return
+		}
+		if status == nil {
+			return
+		}
+	}
+}
+
+// HandleImageRetry queues the processing of an image that failed again.
+func HandleImageRetry(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+
+	err := image.Retry()
+	if err != nil {
+		panic(err)
+	}
+	http.Redirect(w, r, image.ShowRoute()+"?flash=Processing+again", http.StatusFound)
+}
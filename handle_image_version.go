@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HandleImageAdjust shows the editor, with the versions of the image.
+func HandleImageAdjust(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+	renderImageAdjust(w, r, image, nil, nil)
+}
+
+// renderImageAdjust shows the editor, with err and the recipe that caused it
+// if saving failed.
+func renderImageAdjust(w http.ResponseWriter, r *http.Request, image *Image, err error, recipe Recipe) {
+	data := map[string]interface{}{
+		"Image":  image,
+		"Ops":    AdjustmentOps,
+		"Recipe": recipe,
+	}
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+	RenderTemplate(w, r, "images/adjust", data)
+}
+
+func HandleImageAdjustUpdate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+
+	recipe, err := RequestRecipe(r)
+	if err == nil {
+		err = image.Edit(recipe)
+	}
+	if err != nil {
+		if IsValidationError(err) {
+			renderImageAdjust(w, r, image, err, recipe)
+			return
+		}
+		panic(err)
+	}
+	http.Redirect(w, r, image.AdjustRoute()+"?flash=Your+edit+is+being+made", http.StatusFound)
+}
+
+func HandleImageRevert(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+
+	number, err := strconv.Atoi(r.FormValue("version"))
+	if err != nil {
+		err = errInvalidVersion
+	} else {
+		err = image.Revert(number)
+	}
+	if err != nil {
+		if IsValidationError(err) {
+			renderImageAdjust(w, r, image, err, nil)
+			return
+		}
+		panic(err)
+	}
+	http.Redirect(w, r, image.AdjustRoute()+"?flash=Image+reverted", http.StatusFound)
+}
+
+// HandleImageFocus sets the focal point of the image from percentages of
+// its width and height, or leaves it to be found automatically.
+func HandleImageFocus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image := RequireImageOwner(w, r, params)
+	if image == nil {
+		return
+	}
+
+	var point *FocalPoint
+	var err error
+	if r.FormValue("focalAuto") != "1" {
+		point, err = RequestFocalPoint(r)
+	}
+	if err == nil {
+		err = image.SetFocalPoint(point)
+	}
+	if err != nil {
+		if IsValidationError(err) {
+			renderImageAdjust(w, r, image, err, nil)
+			return
+		}
+		panic(err)
+	}
+	http.Redirect(w, r, image.AdjustRoute()+"?flash=The+focal+point+is+being+applied", http.StatusFound)
+}
+
+// RequestFocalPoint reads a focal point given in percent.
+func RequestFocalPoint(r *http.Request) (*FocalPoint, error) {
+	x, err1 := strconv.ParseFloat(r.FormValue("focalX"), 64)
+	y, err2 := strconv.ParseFloat(r.FormValue("focalY"), 64)
+	if err1 != nil || err2 != nil {
+		return nil, errInvalidFocalPoint
+	}
+	return &FocalPoint{x / 100, y / 100}, nil
+}
+
+// RequestRecipe reads the adjustments of the editor form, in order. Rows
+// without an adjustment, like the one for adding one, are skipped.
+func RequestRecipe(r *http.Request) (Recipe, error) {
+	r.ParseForm()
+	ops := r.Form["adjustmentOp"]
+	fields := [][]string{
+		r.Form["adjustmentValue"],
+		r.Form["adjustmentX"],
+		r.Form["adjustmentY"],
+		r.Form["adjustmentWidth"],
+		r.Form["adjustmentHeight"],
+	}
+	for _, values := range fields {
+		if len(values) != len(ops) {
+			return nil, errInvalidAdjustment
+		}
+	}
+
+	remove := map[string]bool{}
+	for _, i := range r.Form["adjustmentRemove"] {
+		remove[i] = true
+	}
+
+	recipe := Recipe{}
+	for i, op := range ops {
+		if remove[strconv.Itoa(i)] || op == "" {
+			continue
+		}
+		adjustment := Adjustment{Op: op}
+		var err error
+		if value := strings.TrimSpace(fields[0][i]); value != "" {
+			adjustment.Value, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, errInvalidAdjustment
+			}
+		}
+		for j, dst := range []*int{&adjustment.X, &adjustment.Y, &adjustment.Width, &adjustment.Height} {
+			if value := strings.TrimSpace(fields[j+1][i]); value != "" {
+				*dst, err = strconv.Atoi(value)
+				if err != nil {
+					return nil, errInvalidAdjustment
+				}
+			}
+		}
+		recipe = append(recipe, adjustment)
+	}
+	return recipe, nil
+}
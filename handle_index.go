@@ -9,12 +9,24 @@ import (
 func HandleHome(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	db := NewDBImageStore()
 	defer db.Close()
-	images, err := db.FindAll(0)
+	page, err := db.FindAll(RequestPage(r))
+	if err == errInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
+	page.Path = r.URL.Path
+
+	if r.URL.Query().Get("format") == "json" {
+		RenderImagePageJSON(w, page)
+		return
+	}
+
 	// Display homepage
 	RenderTemplate(w, r, "index/home", map[string]interface{}{
-		"Images": images,
+		"Images": page.Images,
+		"Page":   page,
 	})
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// colorSearchLimit is the most images a search by colour shows
+const colorSearchLimit = 48
+
+// HandleSearch finds images by colour, from a color query parameter such as
+// #ff8800.
+func HandleSearch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	color := r.URL.Query().Get("color")
+	if color == "" {
+		RenderTemplate(w, r, "images/search", nil)
+		return
+	}
+
+	target, err := ParseHexColor(color)
+	if err != nil {
+		if r.URL.Query().Get("format") == "json" {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		RenderTemplate(w, r, "images/search", map[string]interface{}{
+			"Error": err.Error(),
+			"Color": color,
+		})
+		return
+	}
+
+	db := NewDBImageStore()
+	defer db.Close()
+	images, err := db.FindByColor(target, colorSearchLimit)
+	if err != nil {
+		panic(err)
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		RenderImagePageJSON(w, &ImagePage{Images: images, Path: r.URL.Path})
+		return
+	}
+
+	RenderTemplate(w, r, "images/search", map[string]interface{}{
+		"Images": images,
+		"Color":  color,
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The tus protocol resumable uploads follow, see https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusChunkType  = "application/offset+octet-stream"
+)
+
+// HandleUploadOptions tells tus clients what the server supports.
+func HandleUploadOptions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.UploadMaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUploadCreate starts a resumable upload of Upload-Length bytes. The
+// Upload-Metadata can give the filename and description of the image, and
+// allowDuplicate.
+func HandleUploadCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !requireTusVersion(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > config.UploadMaxSize {
+		http.Error(w, errImageTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := RequestUser(r)
+	db := NewDBImageStore()
+	open, err := db.CountOpenUploads(user)
+	db.Close()
+	if err != nil {
+		panic(err)
+	}
+	if open >= config.UploadMaxOpen {
+		http.Error(w, "Too many uploads are going at once, finish or delete some first", http.StatusTooManyRequests)
+		return
+	}
+
+	upload := NewUpload(user, length, metadata)
+	err = upload.Create()
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Location", upload.Route())
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleUploadHead tells how much of an upload was received, so the client
+// knows where to carry on. Once complete, Gophr-Image is where the image
+// made of it is shown.
+func HandleUploadHead(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	upload := RequireUpload(w, r, params)
+	if upload == nil {
+		return
+	}
+	writeUploadHeaders(w, upload)
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatUploadMetadata(upload.Metadata))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleUploadPatch adds a chunk to an upload, starting at Upload-Offset.
+// The chunk that completes it has the image made, and is answered with any
+// error doing so.
+func HandleUploadPatch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	upload := RequireUpload(w, r, params)
+	if upload == nil {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusChunkType {
+		http.Error(w, "Content-Type must be "+tusChunkType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+
+	if offset != upload.Offset {
+		writeUploadHeaders(w, upload)
+		http.Error(w, "Upload-Offset doesn't match the bytes received", http.StatusConflict)
+		return
+	}
+
+	// Another request, maybe to another instance, may add to the upload at
+	// the same time. Only the first to move the offset on gets its chunk in.
+	if !upload.Complete() {
+		err = upload.Append(r.Body)
+		if err == errUploadChanged {
+			http.Error(w, "The upload was added to by another request", http.StatusConflict)
+			return
+		}
+		if err == errUploadChunkTooSmall {
+			writeUploadHeaders(w, upload)
+			http.Error(w, "Chunks must be at least 1 MB, except the last", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	if upload.Complete() && !upload.Finished() {
+		_, err = upload.Finish(RequestUser(r))
+		if err == errUploadChanged {
+			writeUploadHeaders(w, upload)
+			http.Error(w, "The upload is being made into an image by another request", http.StatusConflict)
+			return
+		}
+		if err != nil && !IsValidationError(err) {
+			panic(err)
+		}
+	}
+
+	writeUploadHeaders(w, upload)
+	if upload.Error != "" {
+		http.Error(w, upload.Error, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUploadDelete gives up on an upload.
+func HandleUploadDelete(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	upload := RequireUpload(w, r, params)
+	if upload == nil {
+		return
+	}
+	err := upload.Delete()
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequireUpload returns the upload of the request, or answers with why there
+// is none to go on with. Uploads of other users are as good as missing.
+func RequireUpload(w http.ResponseWriter, r *http.Request, params httprouter.Params) *Upload {
+	if !requireTusVersion(w, r) {
+		return nil
+	}
+	db := NewDBImageStore()
+	defer db.Close()
+	upload, err := db.FindUpload(params.ByName("uploadID"))
+	if err != nil {
+		panic(err)
+	}
+
+	user := RequestUser(r)
+	if upload == nil || user == nil || upload.UserID != user.ID {
+		http.NotFound(w, r)
+		return nil
+	}
+	if upload.Expired() {
+		http.Error(w, "The upload expired", http.StatusGone)
+		return nil
+	}
+	return upload
+}
+
+// requireTusVersion answers requests made with another version of the
+// protocol.
+func requireTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func writeUploadHeaders(w http.ResponseWriter, upload *Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	if upload.ImageID != "" {
+		w.Header().Set("Gophr-Image", "/image/"+upload.ImageID)
+	}
+}
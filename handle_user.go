@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -54,6 +56,15 @@ func HandleUserUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 	newPassword := r.FormValue("newPassword")
 
 	user, err := UpdateUser(currentUser, email, currentPassword, newPassword)
+	if err == nil {
+		var zones []PrivacyZone
+		zones, err = RequestPrivacyZones(r)
+		if err == nil {
+			err = currentUser.UpdatePrivacy(r.FormValue("metadataPolicy"), zones)
+		}
+		user.MetadataPolicy = currentUser.MetadataPolicy
+		user.PrivacyZones = currentUser.PrivacyZones
+	}
 	if err != nil {
 		if IsValidationError(err) {
 			RenderTemplate(w, r, "users/edit", map[string]interface{}{
@@ -73,6 +84,41 @@ func HandleUserUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 	http.Redirect(w, r, "/account?flash=User+Updated", http.StatusFound)
 }
 
+// RequestPrivacyZones reads the privacy zones of the account form. Rows left
+// empty, like the one for adding a zone, are skipped.
+func RequestPrivacyZones(r *http.Request) ([]PrivacyZone, error) {
+	r.ParseForm()
+	names := r.Form["zoneName"]
+	latitudes := r.Form["zoneLatitude"]
+	longitudes := r.Form["zoneLongitude"]
+	radii := r.Form["zoneRadius"]
+	if len(latitudes) != len(names) || len(longitudes) != len(names) || len(radii) != len(names) {
+		return nil, errInvalidPrivacyZone
+	}
+
+	remove := map[string]bool{}
+	for _, i := range r.Form["zoneRemove"] {
+		remove[i] = true
+	}
+
+	zones := []PrivacyZone{}
+	for i := range names {
+		if remove[strconv.Itoa(i)] || latitudes[i] == "" && longitudes[i] == "" {
+			continue
+		}
+		zone := PrivacyZone{Name: strings.TrimSpace(names[i])}
+		var err1, err2, err3 error
+		zone.Latitude, err1 = strconv.ParseFloat(latitudes[i], 64)
+		zone.Longitude, err2 = strconv.ParseFloat(longitudes[i], 64)
+		zone.Radius, err3 = strconv.ParseFloat(radii[i], 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, errInvalidPrivacyZone
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
 func HandleUserShow(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	user, err := globalUserStore.Find(params.ByName("userID"))
 	if err != nil {
@@ -86,13 +132,30 @@ func HandleUserShow(w http.ResponseWriter, r *http.Request, params httprouter.Pa
 
 	db := NewDBImageStore()
 	defer db.Close()
-	images, err := db.FindAllByUser(user, 0)
+	page, err := db.FindAllByUser(user, RequestPage(r))
+	if err == errInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	page.Path = r.URL.Path
+
+	if r.URL.Query().Get("format") == "json" {
+		RenderImagePageJSON(w, page)
+		return
+	}
+
+	count, err := db.Count(user)
 	if err != nil {
 		panic(err)
 	}
 
 	RenderTemplate(w, r, "users/show", map[string]interface{}{
-		"Images": images,
-		"User":   user,
+		"Images":     page.Images,
+		"ImageCount": count,
+		"Page":       page,
+		"User":       user,
 	})
 }
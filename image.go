@@ -1,17 +1,15 @@
 package main
 
 import (
-	"image"
-	"io"
-	"mime"
+	goimage "image"
 	"mime/multipart"
-	"net/http"
-	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/disintegration/imaging"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func init() {
@@ -19,18 +17,7 @@ func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
-const (
-	imageIDLength = 10
-	widthTumbnail = 400
-	widthPreview  = 800
-)
-
-// A map of accepted mime types and their file extension
-var mimeExtension = map[string]string{
-	"image/png":  ".png",
-	"image/jpeg": ".jpg",
-	"image/gif":  ".gif",
-}
+const imageIDLength = 10
 
 type Image struct {
 	ID          string `bson:"_id" json:"id"`
@@ -40,6 +27,45 @@ type Image struct {
 	Size        int64
 	CreatedAt   time.Time `bson:"created_at"`
 	Description string
+	Digest      string     `bson:"digest"`
+	DeletedAt   *time.Time `bson:"deleted_at,omitempty"`
+	// Where each rendition is stored, by rendition name
+	Renditions map[string]string `bson:"renditions,omitempty"`
+	// Camera metadata of JPEG uploads, if there was any
+	EXIF *ImageEXIF `bson:"exif,omitempty"`
+	// Number of pages of a TIFF upload, only the first is shown
+	Pages int `bson:"pages,omitempty"`
+	// Animated GIFs have a still poster of each animated rendition, by
+	// rendition name
+	Animated bool              `bson:"animated,omitempty"`
+	Posters  map[string]string `bson:"posters,omitempty"`
+	// Perceptual hash of the picture, and the keys it's indexed under
+	PHash      string   `bson:"phash,omitempty"`
+	PHashBands []string `bson:"phash_bands,omitempty"`
+	// Dominant colours, most covering first, and the keys they're indexed
+	// under
+	Palette     []PaletteColor `bson:"palette,omitempty"`
+	PaletteBins []string       `bson:"palette_bins,omitempty"`
+	// Adjustments made in the editor, and every version the image has
+	// been through. Images never edited have no versions.
+	Recipe   Recipe         `bson:"recipe,omitempty"`
+	Versions []ImageVersion `bson:"versions,omitempty"`
+	// What crops keep in view, found automatically when not set
+	FocalPoint *FocalPoint `bson:"focal_point,omitempty"`
+	// An edit waiting for its renditions, which are made in the background,
+	// and why the last one couldn't be made
+	PendingEdit *ImageVersion `bson:"pending_edit,omitempty"`
+	EditError   string        `bson:"edit_error,omitempty"`
+	// Renditions are generated in the background, until then the image is
+	// processing
+	Status string `bson:"status,omitempty"`
+
+	// Uploads that look like an image the user already has are refused,
+	// unless DuplicateAllowed is set. Those that could only be told apart
+	// once processed are kept, and point at the image they look like.
+	DuplicateAllowed bool   `bson:"duplicate_allowed,omitempty"`
+	DuplicateOf      string `bson:"duplicate_of,omitempty"`
+	duplicate        *Image
 }
 
 func NewImage(user *User) *Image {
@@ -51,91 +77,148 @@ func NewImage(user *User) *Image {
 }
 
 func (image *Image) CreatedFromFile(file multipart.File, headers *multipart.FileHeader) error {
-	// Move our file to an appropriate place, with an appropriate name
 	image.Name = headers.Filename
-	image.Location = image.ID + filepath.Ext(image.Name)
 
-	// Open a file at the target location
-	savedFile, err := os.Create("./data/images/" + image.Location)
+	// Store the uploaded file, unless we already have the same one
+	err := image.storeOriginal(file)
 	if err != nil {
 		return err
 	}
-	defer savedFile.Close()
 
-	// Copy the uploaded file to the target location
-	size, err := io.Copy(savedFile, file)
+	return image.save()
+}
+
+func (image *Image) CreatedFromURL(imageUrl string) error {
+	// Only from public addresses, within limits
+	body, err := FetchImage(imageUrl)
 	if err != nil {
 		return err
 	}
-	image.Size = size
+	defer body.Close()
 
-	// Create the various resizes of the images
-	err = image.CreatedResizedImages()
+	// Get a name from the URL
+	image.Name = filepath.Base(imageUrl)
+
+	// Store the entire response, unless we already have the same file. Its
+	// type is told from the contents, servers often get Content-Type wrong.
+	err = image.storeOriginal(body)
 	if err != nil {
 		return err
 	}
 
-	// Save the image to the database
+	return image.save()
+}
+
+// save adds a newly created image to the database. If that fails the
+// reference to its original is given up again.
+func (image *Image) save() error {
 	db := NewDBImageStore()
 	defer db.Close()
-	return db.Save(image)
-}
 
-func (image *Image) CreatedFromURL(imageUrl string) error {
-	// Get response from url
-	response, err := http.Get(imageUrl)
+	err := image.checkDuplicate(db)
+	if err == nil {
+		err = db.Save(image)
+	}
 	if err != nil {
+		image.releaseOriginal()
 		return err
 	}
-
-	// Make sure we have a response
-	if response.StatusCode != http.StatusOK {
-		return errImageURLInvalid
+	// Queued only now, so the job finds the image waiting for it
+	if image.Processing() {
+		return globalJobQueue.Enqueue(jobRenditions, image.Digest)
 	}
-	defer response.Body.Close()
+	return nil
+}
+
+// AllowDuplicate lets the image be saved even if it looks like one its
+// owner already has.
+func (image *Image) AllowDuplicate() {
+	image.DuplicateAllowed = true
+}
+
+// Duplicate is the image an upload was refused for looking like.
+func (image *Image) Duplicate() *Image {
+	return image.duplicate
+}
 
-	// Ascertain the type of file we downloaded
-	mimeType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+func (image *Image) checkDuplicate(db *DBImageStore) error {
+	if image.DuplicateAllowed {
+		return nil
+	}
+	duplicate, err := db.FindDuplicate(image)
 	if err != nil {
-		return errInvalidImageType
+		return err
+	}
+	if duplicate != nil {
+		image.duplicate = duplicate
+		return errDuplicateImage
 	}
+	return nil
+}
+
+// Trash hides the image everywhere but the owner's trash. It is purged for
+// good after config.TrashRetention, unless it's restored first.
+func (image *Image) Trash() error {
+	now := time.Now()
+	image.DeletedAt = &now
+	return image.updateFields(bson.M{"$set": bson.M{"deleted_at": now}})
+}
 
-	// Get an extension for the file
-	ext, valid := mimeExtension[mimeType]
-	if !valid {
-		return errInvalidImageType
+// Restore takes the image back out of the trash.
+func (image *Image) Restore() error {
+	image.DeletedAt = nil
+	return image.updateFields(bson.M{"$unset": bson.M{"deleted_at": ""}})
+}
+
+// UpdateDetails saves the name and description of the image.
+func (image *Image) UpdateDetails() error {
+	return image.updateFields(bson.M{"$set": bson.M{"name": image.Name, "description": image.Description}})
+}
+
+// updateFields applies update to the stored image. Only the fields it names
+// change, so a version saved by an edit in the meantime is kept.
+func (image *Image) updateFields(update bson.M) error {
+	db := NewDBImageStore()
+	defer db.Close()
+	return db.Session.DB(dbName).C(collectionName).UpdateId(image.ID, update)
+}
+
+// InTrash reports whether the image has been deleted but not purged yet.
+func (image *Image) InTrash() bool {
+	return image.DeletedAt != nil
+}
+
+// PurgeDate is when an image in the trash will be deleted for good.
+func (image *Image) PurgeDate() time.Time {
+	if image.DeletedAt == nil {
+		return time.Time{}
 	}
+	return image.DeletedAt.Add(config.TrashRetention)
+}
 
-	// Get a name from the URL
-	image.Name = filepath.Base(imageUrl)
-	image.Location = image.ID + ext
+// Delete removes the image, and its files once no other image shares them.
+func (image *Image) Delete() error {
+	db := NewDBImageStore()
+	defer db.Close()
 
-	// Open a file at target location
-	savedFile, err := os.Create("./data/images/" + image.Location)
+	removed, err := db.Delete(image)
 	if err != nil {
 		return err
 	}
-	defer savedFile.Close()
-
-	// Copy the entire response to the output file
-	size, err := io.Copy(savedFile, response.Body)
+	// Whoever removed it has its files and its reference to the blob to
+	// give up, doing it again would release files other images still use
+	if !removed {
+		return nil
+	}
+	err = globalTransformCache.Invalidate(image.ID)
 	if err != nil {
 		return err
 	}
-
-	// The returned value from io.Copy is the number of bytes copied
-	image.Size = size
-
-	// Create the various resizes of the images
-	err = image.CreatedResizedImages()
+	err = image.deleteVersionFiles()
 	if err != nil {
 		return err
 	}
-
-	// Save our image to the store
-	db := NewDBImageStore()
-	defer db.Close()
-	return db.Save(image)
+	return image.releaseOriginal()
 }
 
 // This method automatically called by html template
@@ -148,55 +231,225 @@ func (image *Image) ShowRoute() string {
 	return "/image/" + image.ID
 }
 
+func (image *Image) EditRoute() string {
+	return "/image/" + image.ID + "/edit"
+}
+
+func (image *Image) DeleteRoute() string {
+	return "/image/" + image.ID + "/delete"
+}
+
+func (image *Image) RestoreRoute() string {
+	return "/image/" + image.ID + "/restore"
+}
+
+func (image *Image) PurgeRoute() string {
+	return "/image/" + image.ID + "/purge"
+}
+
+// CreatedResizedImages generates every configured rendition of the
+// original, and records where each of them was stored.
 func (image *Image) CreatedResizedImages() error {
-	// generate an image from file
-	srcImage, err := imaging.Open("./data/images/" + image.Location)
+	return image.generateRenditions(image.Location)
+}
+
+// generateRenditions generates every rendition of the image as it's shown,
+// storing them under names made from location.
+func (image *Image) generateRenditions(location string) error {
+	// generate an image from the original
+	srcImage, err := image.decodeOriginal()
 	if err != nil {
 		return err
 	}
 
-	// Create a channel to receive errors on
-	errorChan := make(chan error)
+	// For finding images that look alike
+	image.setPHash(phashString(PerceptualHash(srcImage)))
+	// and for searching by colour
+	image.setPalette(ExtractPalette(srcImage))
+
+	// Animated GIFs keep their animation, with a still poster next to it
+	anim, err := image.decodeAnimation()
+	if err != nil {
+		return err
+	}
+	image.Animated = anim != nil
+
+	// Every frame is cropped alike, around the point found on the first
+	focus := image.focus(srcImage)
+
+	type result struct {
+		rendition string
+		name      string
+		poster    string
+		err       error
+	}
 
-	// Process each size
-	go image.resizePreview(errorChan, srcImage)
-	go image.resizeThumbnail(errorChan, srcImage)
+	// Create a channel to receive results on
+	results := make(chan result)
+
+	// Process each rendition
+	for i := range renditions {
+		go func(rendition *Rendition) {
+			if anim == nil || rendition.format(location, srcImage) != "gif" {
+				name, err := rendition.Generate(srcImage, focus, location)
+				results <- result{rendition.Name, name, "", err}
+				return
+			}
+			name, err := rendition.GenerateAnimated(anim, focus, location)
+			if err != nil {
+				results <- result{rendition.Name, name, "", err}
+				return
+			}
+			poster, err := rendition.GeneratePoster(anim, focus, location)
+			results <- result{rendition.Name, name, poster, err}
+		}(&renditions[i])
+	}
 
 	// Wait for images to finish resizing
 	/*We could have returned early if we discovered an error; however, it would mean
 	that if we received an error on the first iteration of the loop and returned, the
-	second iteration would never occur and the second goroutine never complete.
-	This would cause the goroutine to remain in memory.*/
-	var e error
-	for i := 0; i < 2; i++ {
-		e = <-errorChan
-		if err == nil {
-			err = e
+	other iterations would never occur and their goroutines never complete.
+	This would cause the goroutines to remain in memory.*/
+	image.Renditions = map[string]string{}
+	image.Posters = nil
+	for range renditions {
+		r := <-results
+		// Keep track of what was stored, so it's cleaned up on errors too
+		if r.name != "" {
+			image.Renditions[r.rendition] = r.name
+		}
+		if r.poster != "" {
+			if image.Posters == nil {
+				image.Posters = map[string]string{}
+			}
+			image.Posters[r.rendition] = r.poster
+		}
+		if r.err != nil && err == nil {
+			err = r.err
 		}
 	}
 	return err
 }
 
-func (image *Image) resizeThumbnail(errorChan chan error, srcImage image.Image) {
-	dstImage := imaging.Thumbnail(srcImage, widthTumbnail, widthTumbnail, imaging.Lanczos)
+// decodeAnimation reads all frames of an animated GIF original, with the
+// edits applied to each. It returns nil for anything else.
+func (image *Image) decodeAnimation() (*Animation, error) {
+	if strings.ToLower(filepath.Ext(image.Location)) != ".gif" {
+		return nil, nil
+	}
+	original, _, err := globalBlobStore.Get(image.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Close()
+
+	var anim *Animation
+	err = decodeSafely(func() error {
+		anim, err = DecodeAnimation(original)
+		return err
+	})
+	if err != nil || anim == nil || len(image.Recipe) == 0 {
+		return anim, err
+	}
+	for i, frame := range anim.Frames {
+		edited, err := image.Recipe.Apply(frame)
+		if err != nil {
+			return nil, err
+		}
+		anim.Frames[i] = imaging.Clone(edited)
+	}
+	return anim, nil
+}
+
+// decodeOriginal reads the original from the blob store, turns it upright
+// and applies the edits, which gives the image as it's shown.
+func (image *Image) decodeOriginal() (goimage.Image, error) {
+	original, _, err := globalBlobStore.Get(image.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Close()
+
+	var srcImage goimage.Image
+	err = decodeSafely(func() error {
+		srcImage, err = imaging.Decode(original)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return image.Recipe.Apply(image.EXIF.Orient(srcImage))
+}
+
+// blobNames lists the original and every rendition of it, which are shared
+// by every image of the same blob. Renditions of edits are listed by
+// versionBlobNames.
+func (image *Image) blobNames() []string {
+	renditions, posters := image.originalRenditions()
+	if renditions == nil {
+		return []string{
+			image.Location,
+			"thumbnail/" + image.Location,
+			"preview/" + image.Location,
+		}
+	}
+
+	names := []string{image.Location}
+	for _, name := range renditions {
+		names = append(names, name)
+	}
+	for _, name := range posters {
+		names = append(names, name)
+	}
+	return names
+}
+
+// deleteFiles removes the original and renditions from the blob store.
+func (image *Image) deleteFiles() error {
+	return deleteBlobs(image.blobNames())
+}
 
-	destination := "./data/images/thumbnail/" + image.Location
-	errorChan <- imaging.Save(dstImage, destination)
+// deleteBlobs removes every named blob, carrying on past errors.
+func deleteBlobs(names []string) error {
+	var err error
+	for _, name := range names {
+		if e := globalBlobStore.Delete(name); err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
-func (image *Image) resizePreview(errorChan chan error, srcImage image.Image) {
-	size := srcImage.Bounds().Size()
-	ratio := float64(size.Y) / float64(size.X)
-	targetHeight := int(float64(widthPreview) * ratio)
+// RenditionURL is where the rendition with the given name is served, as in
+// {{.Image.RenditionURL "square"}}. Images from before renditions were
+// configurable only have a thumbnail and a preview, which sit next to the
+// original. Images still processing show a placeholder.
+func (image *Image) RenditionURL(name string) string {
+	if image.Status != "" {
+		return image.placeholderURL()
+	}
+	if image.Renditions == nil {
+		return "/im/" + name + "/" + image.Location
+	}
+	location, ok := image.Renditions[name]
+	if !ok {
+		return image.StaticRoute()
+	}
+	return "/im/" + location
+}
 
-	dstImage := imaging.Resize(srcImage, widthPreview, targetHeight, imaging.Lanczos)
-	destination := "./data/images/preview/" + image.Location
-	errorChan <- imaging.Save(dstImage, destination)
+// PosterURL is where a still of the rendition with the given name is
+// served. It's the rendition itself unless the image is animated.
+func (image *Image) PosterURL(name string) string {
+	if location, ok := image.Posters[name]; ok {
+		return "/im/" + location
+	}
+	return image.RenditionURL(name)
 }
 
 func (image *Image) StaticThumbnailRoute() string {
-	return "/im/thumbnail/" + image.Location
+	return image.RenditionURL("thumbnail")
 }
 func (image *Image) StaticPreviewRoute() string {
-	return "/im/preview/" + image.Location
+	return image.RenditionURL("preview")
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const blobsCollectionName = "blobs"
+
+// ImageBlob is an original stored once per SHA-256 digest of its contents.
+// Every image uploaded with the same bytes points at the same blob, and with
+// it the same renditions. Refs counts those images.
+type ImageBlob struct {
+	Digest    string    `bson:"_id"`
+	Location  string    `bson:"location"`
+	Size      int64     `bson:"size"`
+	Refs      int       `bson:"refs"`
+	CreatedAt time.Time `bson:"created_at"`
+	// The renditions generated from the blob, as in Image.Renditions
+	Renditions map[string]string `bson:"renditions,omitempty"`
+	Animated   bool              `bson:"animated,omitempty"`
+	Posters    map[string]string `bson:"posters,omitempty"`
+	PHash      string            `bson:"phash,omitempty"`
+	Palette    []PaletteColor    `bson:"palette,omitempty"`
+	// As Image.Status, until the renditions are generated
+	Status string `bson:"status,omitempty"`
+}
+
+// RefBlob adds a reference to the blob with the given digest and returns it.
+// It returns nil if there is no such blob yet.
+func (store *DBImageStore) RefBlob(digest string) (*ImageBlob, error) {
+	blob := &ImageBlob{}
+	_, err := store.Session.DB(dbName).C(blobsCollectionName).FindId(digest).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"refs": 1}},
+		ReturnNew: true,
+	}, blob)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// FindBlob returns the blob with the given digest, or nil if there is none.
+func (store *DBImageStore) FindBlob(digest string) (*ImageBlob, error) {
+	blob := &ImageBlob{}
+	err := store.Session.DB(dbName).C(blobsCollectionName).FindId(digest).One(blob)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// SaveBlob records a newly stored blob with one reference. If the same
+// contents were stored concurrently the existing record wins, and is
+// returned with the reference added to it.
+func (store *DBImageStore) SaveBlob(blob *ImageBlob) (*ImageBlob, error) {
+	saved := &ImageBlob{}
+	_, err := store.Session.DB(dbName).C(blobsCollectionName).FindId(blob.Digest).Apply(mgo.Change{
+		Update: bson.M{
+			"$inc": bson.M{"refs": 1},
+			"$setOnInsert": bson.M{
+				"location":   blob.Location,
+				"size":       blob.Size,
+				"created_at": blob.CreatedAt,
+				"renditions": blob.Renditions,
+				"animated":   blob.Animated,
+				"posters":    blob.Posters,
+				"phash":      blob.PHash,
+				"palette":    blob.Palette,
+				"status":     blob.Status,
+			},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, saved)
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// UnrefBlob drops a reference to the blob with the given digest. It returns
+// true if that was the last one, in which case the record is gone and the
+// caller should remove the files. Contents stored again after that get a
+// new record and files of their own, so removing these can't hurt them.
+func (store *DBImageStore) UnrefBlob(digest string) (bool, error) {
+	c := store.Session.DB(dbName).C(blobsCollectionName)
+
+	blob := &ImageBlob{}
+	_, err := c.FindId(digest).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"refs": -1}},
+		ReturnNew: true,
+	}, blob)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil || blob.Refs > 0 {
+		return false, err
+	}
+
+	// Only remove it if nobody took a new reference in the meantime
+	err = c.Remove(bson.M{"_id": digest, "refs": bson.M{"$lte": 0}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// storeOriginal hashes r while spooling it to a temporary file, and points
+// the image at the blob with that digest. The bytes are only stored, and the
+// renditions only generated, if no earlier upload had the same contents.
+// Until they are, the image is processing.
+func (image *Image) storeOriginal(r io.Reader) error {
+	spool, err := ioutil.TempFile("", "gophr-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// One byte more than allowed tells a file that's too large
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), io.LimitReader(r, config.UploadMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if size > config.UploadMaxSize {
+		return errImageTooLarge
+	}
+	image.Digest = hex.EncodeToString(hash.Sum(nil))
+	image.Size = size
+
+	// Trust the contents, not the name or Content-Type, and check the
+	// size of the picture before anything decodes all of it
+	var format string
+	err = decodeSafely(func() error {
+		format, err = sniffImageFormat(spool)
+		if err == nil {
+			err = checkImageDimensions(spool)
+		}
+		if err == nil {
+			err = image.readImageMetadata(spool, format)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db := NewDBImageStore()
+	defer db.Close()
+
+	blob, err := db.RefBlob(image.Digest)
+	if err != nil {
+		return err
+	}
+	if blob == nil {
+		blob, err = image.storeBlob(db, spool, format)
+		if err != nil {
+			return err
+		}
+	}
+	image.useBlob(blob)
+
+	// Uploading a file that failed to process gives it another go
+	if image.Failed() {
+		image.Status = imageProcessing
+		return db.setBlobStatus(image.Digest, imageFailed, imageProcessing)
+	}
+	return nil
+}
+
+// storeBlob stores the bytes of a new upload, and records them as a blob
+// with one reference. Its renditions are generated in the background, by a
+// job queued once the image is saved.
+//
+// The name is new every time, so the files of a blob whose last image was
+// just deleted are never the ones a fresh upload of the same bytes uses.
+func (image *Image) storeBlob(db *DBImageStore, spool io.ReadSeeker, format string) (*ImageBlob, error) {
+	location := GenerateID(image.Digest, 8) + uploadExtension[format]
+	_, err := spool.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = globalBlobStore.Put(location, spool)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := db.SaveBlob(&ImageBlob{
+		Digest:    image.Digest,
+		Location:  location,
+		Size:      image.Size,
+		CreatedAt: time.Now(),
+		Status:    imageProcessing,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Someone stored the same contents meanwhile, use theirs
+	if blob.Location != location {
+		globalBlobStore.Delete(location)
+	}
+	return blob, nil
+}
+
+// useBlob points the image at the files of blob.
+func (image *Image) useBlob(blob *ImageBlob) {
+	image.Location = blob.Location
+	image.Renditions = blob.Renditions
+	image.Animated = blob.Animated
+	image.Posters = blob.Posters
+	image.setPHash(blob.PHash)
+	image.setPalette(blob.Palette)
+	image.Status = blob.Status
+}
+
+// releaseOriginal drops the image's reference to its blob, and removes the
+// original and its renditions once no image uses them any more.
+func (image *Image) releaseOriginal() error {
+	// Images from before deduplication have files of their own
+	if image.Digest == "" {
+		return image.deleteFiles()
+	}
+
+	db := NewDBImageStore()
+	defer db.Close()
+
+	last, err := db.UnrefBlob(image.Digest)
+	if err != nil || !last {
+		return err
+	}
+	return image.deleteFiles()
+}
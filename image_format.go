@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	goimage "image"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// imageSniffLength is how much of a file sniffImageFormat looks at
+const imageSniffLength = 16
+
+// The magic bytes each accepted format starts with
+var imageSignatures = []struct {
+	format    string
+	signature []byte
+}{
+	{"jpeg", []byte{0xFF, 0xD8, 0xFF}},
+	{"png", []byte("\x89PNG\r\n\x1a\n")},
+	{"gif", []byte("GIF87a")},
+	{"gif", []byte("GIF89a")},
+	{"tiff", []byte("II*\x00")},
+	{"tiff", []byte("MM\x00*")},
+	{"bmp", []byte("BM")},
+}
+
+// A map of accepted upload formats and the extension originals are stored
+// with
+var uploadExtension = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"tiff": ".tif",
+	"bmp":  ".bmp",
+}
+
+// sniffImageFormat tells the format of an upload from its first bytes,
+// whatever its name or Content-Type claim. It returns errInvalidImageType
+// for anything that isn't one of the accepted formats. The file is left at
+// its start.
+func sniffImageFormat(file io.ReadSeeker) (string, error) {
+	_, err := file.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, imageSniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	for _, magic := range imageSignatures {
+		if bytes.HasPrefix(head[:n], magic.signature) {
+			return magic.format, nil
+		}
+	}
+	return "", errInvalidImageType
+}
+
+// checkImageDimensions reads the size of the picture from the header of an
+// upload, and refuses it if decoding it would take more memory than
+// config.UploadMaxDimension and config.UploadMaxPixels allow. The file is
+// left at its start.
+func checkImageDimensions(file io.ReadSeeker) error {
+	defer file.Seek(0, 0)
+
+	imageConfig, _, err := goimage.DecodeConfig(file)
+	if err != nil {
+		return errInvalidImage
+	}
+	width, height := imageConfig.Width, imageConfig.Height
+	if width <= 0 || height <= 0 {
+		return errInvalidImage
+	}
+	if width > config.UploadMaxDimension || height > config.UploadMaxDimension ||
+		int64(width)*int64(height) > int64(config.UploadMaxPixels) {
+		return errImageTooManyPixels
+	}
+	return nil
+}
+
+// decodeSafely runs decode, turning a panic of a decoder fed a malformed
+// file into errInvalidImage.
+func decodeSafely(decode func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error decoding image: %v", r)
+			err = errInvalidImage
+		}
+	}()
+	return decode()
+}
+
+// readImageMetadata reads what metadata there is in an upload of the given
+// format. Broken metadata doesn't stop an upload, it's just left out. The
+// file is left at its start.
+func (image *Image) readImageMetadata(file io.ReadSeeker, format string) error {
+	defer file.Seek(0, 0)
+
+	switch format {
+	case "jpeg":
+		image.EXIF, _ = ReadEXIF(file)
+	case "tiff":
+		// TIFF files are one big TIFF structure, as the EXIF block of a
+		// JPEG is, so both are read alike
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		image.EXIF, _ = parseEXIF(data)
+		image.Pages = countTIFFPages(data)
+	}
+	return nil
+}
+
+// countTIFFPages counts the pages of a TIFF file, which have an IFD each.
+// Only the first one is shown, but it's good to know there are more.
+func countTIFFPages(data []byte) int {
+	tiff, offset, err := newTIFFData(data)
+	if err != nil {
+		return 0
+	}
+	pages, err := tiff.countIFDs(offset)
+	if err != nil {
+		return 0
+	}
+	return pages
+}
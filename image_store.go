@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -17,9 +22,35 @@ type DBImageStore struct {
 
 type ImageStore interface {
 	Save(image *Image) error
+	Update(image *Image) error
+	Delete(image *Image) (bool, error)
 	Find(id string) (*Image, error)
-	FindAll(offset int) ([]Image, error)
-	FindAllByUser(user *User, offset int) ([]Image, error)
+	FindAll(page Page) (*ImagePage, error)
+	FindAllByUser(user *User, page Page) (*ImagePage, error)
+	FindTrashByUser(user *User) ([]Image, error)
+	FindTrashedBefore(t time.Time) ([]Image, error)
+	Count(user *User) (int, error)
+}
+
+// InitImageStore makes sure the images collection has the indexes the
+// queries below rely on.
+func InitImageStore() {
+	db := NewDBImageStore()
+	defer db.Close()
+
+	indexes := [][]string{
+		{"deleted_at", "-created_at", "-_id"},
+		{"user_id", "deleted_at", "-created_at", "-_id"},
+		{"location"},
+		{"phash_bands"},
+		{"palette_bins"},
+	}
+	for _, key := range indexes {
+		err := db.Session.DB(dbName).C(collectionName).EnsureIndexKey(key...)
+		if err != nil {
+			panic(fmt.Errorf("Error creating image indexes: %s", err))
+		}
+	}
 }
 
 func NewDBImageStore() *DBImageStore {
@@ -36,33 +67,126 @@ func (store *DBImageStore) Save(image *Image) error {
 	return nil
 }
 
+func (store *DBImageStore) Update(image *Image) error {
+	return store.Session.DB(dbName).C(collectionName).UpdateId(image.ID, image)
+}
+
+// Delete removes the image, and reports whether it was there to remove. An
+// image deleted twice at once, as by a purge running on two instances, is
+// only removed by one of them.
+func (store *DBImageStore) Delete(image *Image) (bool, error) {
+	err := store.Session.DB(dbName).C(collectionName).RemoveId(image.ID)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (store *DBImageStore) Find(id string) (*Image, error) {
 	image := &Image{}
 	err := store.Session.DB(dbName).C(collectionName).Find(bson.M{"_id": id}).One(image)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 	return image, nil
 }
 
-func (store *DBImageStore) FindAll(offset int) ([]Image, error) {
+func (store *DBImageStore) FindAll(page Page) (*ImagePage, error) {
+	return store.findPage(bson.M{"deleted_at": nil}, page)
+}
+
+func (store *DBImageStore) FindAllByUser(user *User, page Page) (*ImagePage, error) {
+	return store.findPage(bson.M{"user_id": user.ID, "deleted_at": nil}, page)
+}
+
+func (store *DBImageStore) findPage(query bson.M, page Page) (*ImagePage, error) {
+	sort, err := pageQuery(query, page)
+	if err != nil {
+		return nil, err
+	}
+
+	// One more than needed tells us if there is another page
+	var results []Image
+	err = store.Session.DB(dbName).C(collectionName).Find(query).Sort(sort...).Limit(page.Size + 1).All(&results)
+	if err != nil {
+		return nil, err
+	}
+	return newImagePage(results, page), nil
+}
+
+// FindTrashByUser returns the user's images in the trash, most recently
+// deleted first.
+func (store *DBImageStore) FindTrashByUser(user *User) ([]Image, error) {
 	var results []Image
-	err := store.Session.DB(dbName).C(collectionName).Find(nil).Skip(offset).Limit(pageSize).Sort("-created_at").All(&results)
+	err := store.Session.DB(dbName).C(collectionName).Find(bson.M{"user_id": user.ID, "deleted_at": bson.M{"$ne": nil}}).Sort("-deleted_at").All(&results)
 	if err != nil {
 		return nil, err
 	}
 	return results, nil
 }
 
-func (store *DBImageStore) FindAllByUser(user *User, offset int) ([]Image, error) {
+// FindTrashedBefore returns the images that were moved to the trash before t.
+func (store *DBImageStore) FindTrashedBefore(t time.Time) ([]Image, error) {
 	var results []Image
-	err := store.Session.DB(dbName).C(collectionName).Find(bson.M{"user_id": user.ID}).Skip(offset).Limit(pageSize).Sort("-created_at").All(&results)
+	err := store.Session.DB(dbName).C(collectionName).Find(bson.M{"deleted_at": bson.M{"$lt": t}}).All(&results)
 	if err != nil {
 		return nil, err
 	}
 	return results, nil
 }
 
+// Count returns the number of images the user has, or the number of all
+// images if user is nil. Images in the trash aren't counted.
+func (store *DBImageStore) Count(user *User) (int, error) {
+	query := bson.M{"deleted_at": nil}
+	if user != nil {
+		query["user_id"] = user.ID
+	}
+	return store.Session.DB(dbName).C(collectionName).Find(query).Count()
+}
+
+// findByIDs returns the images with the given IDs, by ID.
+func (store *DBImageStore) findByIDs(ids []string) (map[string]Image, error) {
+	found := map[string]Image{}
+	if len(ids) == 0 {
+		return found, nil
+	}
+	var images []Image
+	err := store.Session.DB(dbName).C(collectionName).Find(bson.M{"_id": bson.M{"$in": ids}}).All(&images)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		found[image.ID] = image
+	}
+	return found, nil
+}
+
+// BlobShown reports whether an image outside the trash uses the blob with the
+// given name. Originals and their renditions are shared by every image with
+// the same location, so any one of them will do. Renditions of a version,
+// stored below the ID of the image, only belong to that image.
+func (store *DBImageStore) BlobShown(name string) (bool, error) {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	query := bson.M{"deleted_at": nil}
+	if len(parts) == 4 && strings.HasPrefix(parts[1], "img_") {
+		query["_id"] = parts[1]
+	} else {
+		// A rendition in another format has its extension added to the
+		// location
+		location := parts[len(parts)-1]
+		query["location"] = bson.M{"$in": []string{location, strings.TrimSuffix(location, filepath.Ext(location))}}
+	}
+	n, err := store.Session.DB(dbName).C(collectionName).Find(query).Limit(1).Count()
+	return n > 0, err
+}
+
 func (store *DBImageStore) Close() {
 	store.Session.Close()
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The job making the renditions of an edit, keyed by the ID of the image
+const jobEdit = "edit"
+
+// The most versions an image keeps. The oldest but the one as uploaded are
+// dropped beyond that, so the history fits in the image's document however
+// often it's edited.
+const maxImageVersions = 20
+
+// ImageVersion is a state an edited image has been in. Each keeps its own
+// renditions, so going back to it needs no work. Version 1 is the image as
+// uploaded, and shares its renditions with every image of the same blob.
+type ImageVersion struct {
+	Number     int               `bson:"number"`
+	Recipe     Recipe            `bson:"recipe,omitempty"`
+	Renditions map[string]string `bson:"renditions,omitempty"`
+	Posters    map[string]string `bson:"posters,omitempty"`
+	PHash      string            `bson:"phash,omitempty"`
+	Palette    []PaletteColor    `bson:"palette,omitempty"`
+	FocalPoint *FocalPoint       `bson:"focal_point,omitempty"`
+	CreatedAt  time.Time         `bson:"created_at"`
+	// The version this one went back to, if it was made by reverting
+	RevertOf int `bson:"revert_of,omitempty"`
+}
+
+func (image *Image) AdjustRoute() string {
+	return "/image/" + image.ID + "/adjust"
+}
+
+func (image *Image) RevertRoute() string {
+	return "/image/" + image.ID + "/revert"
+}
+
+func (image *Image) FocusRoute() string {
+	return "/image/" + image.ID + "/focus"
+}
+
+// CurrentVersion is the number of the version shown.
+func (image *Image) CurrentVersion() int {
+	if len(image.Versions) == 0 {
+		return 1
+	}
+	return image.Versions[len(image.Versions)-1].Number
+}
+
+// version returns the version with the given number, or nil if there is
+// none, or it was dropped.
+func (image *Image) version(number int) *ImageVersion {
+	for i := range image.Versions {
+		if image.Versions[i].Number == number {
+			return &image.Versions[i]
+		}
+	}
+	return nil
+}
+
+// snapshot records the image as it's shown now as a version.
+func (image *Image) snapshot(number int) ImageVersion {
+	return ImageVersion{
+		Number:     number,
+		Recipe:     image.Recipe,
+		Renditions: image.Renditions,
+		Posters:    image.Posters,
+		PHash:      image.PHash,
+		Palette:    image.Palette,
+		FocalPoint: image.FocalPoint,
+		CreatedAt:  time.Now(),
+	}
+}
+
+// useVersion shows the image as it was in version.
+func (image *Image) useVersion(version *ImageVersion) {
+	image.Recipe = version.Recipe
+	image.Renditions = version.Renditions
+	image.Posters = version.Posters
+	image.setPHash(version.PHash)
+	image.setPalette(version.Palette)
+	image.FocalPoint = version.FocalPoint
+}
+
+// originalRenditions returns the renditions and posters of the image as
+// uploaded.
+func (image *Image) originalRenditions() (map[string]string, map[string]string) {
+	if len(image.Versions) > 0 {
+		return image.Versions[0].Renditions, image.Versions[0].Posters
+	}
+	return image.Renditions, image.Posters
+}
+
+// Edit makes recipe the adjustments of the image. The renditions are made
+// anew from the original in the background, and the result is kept as a new
+// version.
+func (image *Image) Edit(recipe Recipe) error {
+	err := recipe.Validate()
+	if err != nil {
+		return err
+	}
+	return image.queueEdit(recipe, image.FocalPoint)
+}
+
+// SetFocalPoint sets what crops of the image keep in view, or with nil
+// leaves it to be found automatically. The renditions are made anew in the
+// background, as a new version.
+func (image *Image) SetFocalPoint(point *FocalPoint) error {
+	if point != nil {
+		err := point.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return image.queueEdit(image.Recipe, point)
+}
+
+// queueEdit records recipe and point as the edit waiting for the image, and
+// queues the job that renders it. One edit waits at a time.
+func (image *Image) queueEdit(recipe Recipe, point *FocalPoint) error {
+	if image.Status != "" {
+		return errImageNotReady
+	}
+	if image.PendingEdit != nil {
+		return errEditPending
+	}
+	if len(recipe) == 0 && point == nil {
+		return image.Revert(1)
+	}
+
+	edit := &ImageVersion{
+		Recipe:     recipe,
+		FocalPoint: point,
+		CreatedAt:  time.Now(),
+	}
+	db := NewDBImageStore()
+	defer db.Close()
+	err := db.Session.DB(dbName).C(collectionName).Update(bson.M{
+		"_id":          image.ID,
+		"pending_edit": nil,
+	}, bson.M{
+		"$set":   bson.M{"pending_edit": edit},
+		"$unset": bson.M{"edit_error": ""},
+	})
+	if err == mgo.ErrNotFound {
+		return errEditPending
+	}
+	if err != nil {
+		return err
+	}
+	image.PendingEdit = edit
+	image.EditError = ""
+	return globalJobQueue.Enqueue(jobEdit, image.ID)
+}
+
+// renderEdit makes the renditions of the edit waiting for the image with the
+// given ID, and shows the result as a new version. An edit that turns out
+// not to fit the image is dropped, and why is kept for the editor to show.
+func renderEdit(id string) error {
+	db := NewDBImageStore()
+	defer db.Close()
+
+	image, err := db.Find(id)
+	if err != nil {
+		return err
+	}
+	if image == nil || image.PendingEdit == nil {
+		return nil
+	}
+	edit := *image.PendingEdit
+	// Unless the image was deleted in the meantime
+	mine := bson.M{"_id": image.ID, "pending_edit.created_at": edit.CreatedAt}
+
+	if len(image.Versions) == 0 {
+		original := image.snapshot(1)
+		original.CreatedAt = image.CreatedAt
+		image.Versions = []ImageVersion{original}
+	}
+	number := image.CurrentVersion() + 1
+
+	// Renditions of edits belong to this image alone, so they're stored
+	// under its ID rather than next to the shared ones. The names are the
+	// same every attempt, so a retry replaces what a failed one left.
+	image.Recipe = edit.Recipe
+	image.FocalPoint = edit.FocalPoint
+	image.Renditions, image.Posters = nil, nil
+	err = image.generateRenditions(fmt.Sprintf("%s/v%d/%s", image.ID, number, image.Location))
+	if err != nil {
+		deleteBlobs(image.renditionNames())
+		if IsValidationError(err) {
+			return db.dropEdit(mine, err)
+		}
+		return err
+	}
+
+	image.Versions = append(image.Versions, image.snapshot(number))
+	dropped := image.trimVersions()
+	err = db.saveVersion(image, mine)
+	if err == mgo.ErrNotFound {
+		deleteBlobs(image.renditionNames())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deleteBlobs(dropped)
+	// Transformations were made from the version shown before
+	return globalTransformCache.Invalidate(image.ID)
+}
+
+// failEdit drops the edit of the image with the given ID once its job gave
+// up on it.
+func failEdit(id string) error {
+	db := NewDBImageStore()
+	defer db.Close()
+	return db.dropEdit(bson.M{"_id": id}, errEditFailed)
+}
+
+// dropEdit drops the edit waiting for the image selector matches, keeping
+// err as the reason.
+func (store *DBImageStore) dropEdit(selector bson.M, err error) error {
+	err = store.Session.DB(dbName).C(collectionName).Update(selector, bson.M{
+		"$set":   bson.M{"edit_error": err.Error()},
+		"$unset": bson.M{"pending_edit": ""},
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// trimVersions drops the oldest versions but the first beyond
+// maxImageVersions. It returns the files only the dropped versions used.
+func (image *Image) trimVersions() []string {
+	extra := len(image.Versions) - maxImageVersions
+	if extra <= 0 {
+		return nil
+	}
+	dropped := image.Versions[1 : 1+extra]
+	kept := append([]ImageVersion{image.Versions[0]}, image.Versions[1+extra:]...)
+
+	// Reverting shares the files of a version with a later one
+	used := map[string]bool{}
+	for i := range kept {
+		for _, name := range versionFiles(&kept[i]) {
+			used[name] = true
+		}
+	}
+	names := []string{}
+	for i := range dropped {
+		names = append(names, namesNotIn(versionFiles(&dropped[i]), used)...)
+	}
+	image.Versions = kept
+	return names
+}
+
+// Revert shows the image as it was in the version with the given number.
+// That is recorded as a new version, so going back can be undone too.
+func (image *Image) Revert(number int) error {
+	if image.Status != "" {
+		return errImageNotReady
+	}
+	if image.PendingEdit != nil {
+		return errEditPending
+	}
+	if len(image.Versions) == 0 && number == 1 {
+		// Never edited, so it's as uploaded already
+		return nil
+	}
+	previous := image.version(number)
+	if previous == nil {
+		return errInvalidVersion
+	}
+
+	version := *previous
+	version.Number = image.CurrentVersion() + 1
+	version.CreatedAt = time.Now()
+	version.RevertOf = number
+	image.useVersion(&version)
+	image.Versions = append(image.Versions, version)
+	dropped := image.trimVersions()
+
+	db := NewDBImageStore()
+	defer db.Close()
+	err := db.saveVersion(image, bson.M{"_id": image.ID, "pending_edit": nil})
+	if err == mgo.ErrNotFound {
+		return errEditPending
+	}
+	if err != nil {
+		return err
+	}
+	deleteBlobs(dropped)
+	return globalTransformCache.Invalidate(image.ID)
+}
+
+// saveVersion records the version the image shows, and its history, if the
+// image still matches selector. Nothing else of the image is touched.
+func (store *DBImageStore) saveVersion(image *Image, selector bson.M) error {
+	set, unset := bson.M{}, bson.M{"pending_edit": ""}
+	setRenditions(set, unset, "", image.Renditions, image.Posters)
+	set["animated"] = image.Animated
+	set["phash"] = image.PHash
+	set["phash_bands"] = image.PHashBands
+	set["palette"] = image.Palette
+	set["palette_bins"] = image.PaletteBins
+	set["recipe"] = image.Recipe
+	set["focal_point"] = image.FocalPoint
+	set["versions"] = image.Versions
+	image.PendingEdit = nil
+	return store.Session.DB(dbName).C(collectionName).Update(selector, bson.M{"$set": set, "$unset": unset})
+}
+
+// VersionThumbnailURL is where the thumbnail of the version with the given
+// number is served.
+func (image *Image) VersionThumbnailURL(number int) string {
+	previous := image.version(number)
+	if previous == nil {
+		return image.StaticThumbnailRoute()
+	}
+	version := *image
+	version.useVersion(previous)
+	return version.StaticThumbnailRoute()
+}
+
+func versionFiles(version *ImageVersion) []string {
+	names := []string{}
+	for _, name := range version.Renditions {
+		names = append(names, name)
+	}
+	for _, name := range version.Posters {
+		names = append(names, name)
+	}
+	return names
+}
+
+// versionBlobNames lists the renditions made for edits of the image, which
+// no other image shares.
+func (image *Image) versionBlobNames() []string {
+	seen := map[string]bool{}
+	for _, name := range image.blobNames() {
+		seen[name] = true
+	}
+	names := []string{}
+	for i := range image.Versions {
+		for _, name := range versionFiles(&image.Versions[i]) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// deleteVersionFiles removes the renditions of edits from the blob store.
+func (image *Image) deleteVersionFiles() error {
+	return deleteBlobs(image.versionBlobNames())
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const jobsCollectionName = "jobs"
+
+// Jobs are waiting to run, running, or dead once they failed
+// jobMaxAttempts times. Finished jobs are removed.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDead    = "dead"
+)
+
+const (
+	jobMaxAttempts = 5
+	// A job is retried after jobRetryDelay, doubling with every attempt
+	// up to jobMaxRetryDelay
+	jobRetryDelay    = 30 * time.Second
+	jobMaxRetryDelay = time.Hour
+	// A running job whose worker hasn't finished it in this time is taken
+	// to have died with its process, and is run again
+	jobLease = 10 * time.Minute
+	// How often idle workers look for jobs queued by other processes
+	jobPollInterval = 5 * time.Second
+)
+
+// Job is a piece of background work, stored in MongoDB so it survives
+// restarts. There is at most one job of a kind for the same key.
+type Job struct {
+	ID         string    `bson:"_id"`
+	Kind       string    `bson:"kind"`
+	Key        string    `bson:"key"`
+	State      string    `bson:"state"`
+	Attempts   int       `bson:"attempts"`
+	RunAt      time.Time `bson:"run_at"`
+	LeaseUntil time.Time `bson:"lease_until,omitempty"`
+	LastError  string    `bson:"last_error,omitempty"`
+	// Set when the job was queued again while running, so it runs once
+	// more after it finishes
+	Requeue   bool      `bson:"requeue,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+// jobKind is what runs the jobs of a kind. Dead is called once a job has
+// failed for good.
+type jobKind struct {
+	Run  func(key string) error
+	Dead func(key string) error
+}
+
+var jobKinds = map[string]jobKind{
+	jobRenditions: {generateBlobRenditions, failBlobRenditions},
+	jobEdit:       {renderEdit, failEdit},
+}
+
+// JobQueue hands out jobs to a fixed number of workers, so however many
+// uploads come in at once only that many images are decoded at a time.
+type JobQueue struct {
+	Session *mgo.Session
+	// Wakes an idle worker when a job is queued by this process
+	wake chan struct{}
+}
+
+var globalJobQueue *JobQueue
+
+// InitJobQueue makes sure the jobs collection has the index workers look
+// for jobs with.
+func InitJobQueue() {
+	globalJobQueue = &JobQueue{
+		Session: mongoSession,
+		wake:    make(chan struct{}, 1),
+	}
+
+	db := globalJobQueue.Session.Copy()
+	defer db.Close()
+	err := db.DB(dbName).C(jobsCollectionName).EnsureIndexKey("state", "run_at")
+	if err != nil {
+		panic(fmt.Errorf("Error creating job indexes: %s", err))
+	}
+}
+
+func jobID(kind, key string) string {
+	return kind + "/" + key
+}
+
+// Enqueue queues a job of the given kind for key, unless one is already
+// waiting. A running job is run again once it finishes, as it may have
+// missed what it was queued for. A dead job is brought back with its
+// attempts reset.
+func (queue *JobQueue) Enqueue(kind, key string) error {
+	db := queue.Session.Copy()
+	defer db.Close()
+	c := db.DB(dbName).C(jobsCollectionName)
+
+	id := jobID(kind, key)
+	now := time.Now()
+	err := c.Update(bson.M{"_id": id, "state": jobDead}, bson.M{
+		"$set":   bson.M{"state": jobQueued, "attempts": 0, "run_at": now, "updated_at": now},
+		"$unset": bson.M{"last_error": ""},
+	})
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	err = c.Update(bson.M{"_id": id, "state": jobRunning}, bson.M{
+		"$set": bson.M{"requeue": true, "updated_at": now},
+	})
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	_, err = c.UpsertId(id, bson.M{
+		"$setOnInsert": bson.M{
+			"kind":       kind,
+			"key":        key,
+			"state":      jobQueued,
+			"attempts":   0,
+			"run_at":     now,
+			"created_at": now,
+			"updated_at": now,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Find returns the job of the given kind for key, or nil if there is none
+// because it finished or was never queued.
+func (queue *JobQueue) Find(kind, key string) (*Job, error) {
+	db := queue.Session.Copy()
+	defer db.Close()
+
+	job := &Job{}
+	err := db.DB(dbName).C(jobsCollectionName).FindId(jobID(kind, key)).One(job)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// claim takes the job that has been due longest, if any, and leases it to
+// the caller.
+func (queue *JobQueue) claim() (*Job, error) {
+	err := queue.buryAbandoned()
+	if err != nil {
+		return nil, err
+	}
+
+	db := queue.Session.Copy()
+	defer db.Close()
+
+	now := time.Now()
+	query := bson.M{"$or": []bson.M{
+		{"state": jobQueued, "run_at": bson.M{"$lte": now}},
+		{"state": jobRunning, "lease_until": bson.M{"$lt": now}, "attempts": bson.M{"$lt": jobMaxAttempts}},
+	}}
+	job := &Job{}
+	_, err = db.DB(dbName).C(jobsCollectionName).Find(query).Sort("run_at").Apply(mgo.Change{
+		Update: bson.M{
+			"$set":   bson.M{"state": jobRunning, "lease_until": now.Add(jobLease), "updated_at": now},
+			"$inc":   bson.M{"attempts": 1},
+			"$unset": bson.M{"requeue": ""},
+		},
+		ReturnNew: true,
+	}, job)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// buryAbandoned marks the jobs whose lease ran out on their last attempt as
+// dead. A job that takes its worker's process down with it, as decoding a
+// file made to use up all memory may, never gets to fail, and would
+// otherwise be run again on every restart.
+func (queue *JobQueue) buryAbandoned() error {
+	db := queue.Session.Copy()
+	defer db.Close()
+	c := db.DB(dbName).C(jobsCollectionName)
+
+	for {
+		now := time.Now()
+		job := &Job{}
+		_, err := c.Find(bson.M{
+			"state":       jobRunning,
+			"lease_until": bson.M{"$lt": now},
+			"attempts":    bson.M{"$gte": jobMaxAttempts},
+		}).Apply(mgo.Change{
+			Update: bson.M{"$set": bson.M{
+				"state":      jobDead,
+				"last_error": "the worker running it went away",
+				"updated_at": now,
+			}},
+			ReturnNew: true,
+		}, job)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Job %s died with its worker on attempt %d", job.ID, job.Attempts)
+		kind, ok := jobKinds[job.Kind]
+		if !ok {
+			continue
+		}
+		err = kind.Dead(job.Key)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// finish records the outcome of running job. Failed jobs are queued again
+// later, until they run out of attempts.
+func (queue *JobQueue) finish(job *Job, runErr error) error {
+	db := queue.Session.Copy()
+	defer db.Close()
+	c := db.DB(dbName).C(jobsCollectionName)
+
+	// Unless the lease ran out and another worker took the job over
+	mine := bson.M{"_id": job.ID, "state": jobRunning, "attempts": job.Attempts}
+	var err error
+	if runErr == nil {
+		err = c.Remove(bson.M{"_id": job.ID, "state": jobRunning, "attempts": job.Attempts, "requeue": bson.M{"$ne": true}})
+		if err == mgo.ErrNotFound {
+			// Queued again while it ran, so it runs once more, afresh
+			err = c.Update(mine, bson.M{
+				"$set":   bson.M{"state": jobQueued, "attempts": 0, "run_at": time.Now(), "updated_at": time.Now()},
+				"$unset": bson.M{"requeue": "", "last_error": ""},
+			})
+		}
+	} else if job.Attempts >= jobMaxAttempts {
+		err = c.Update(mine, bson.M{"$set": bson.M{
+			"state":      jobDead,
+			"last_error": runErr.Error(),
+			"updated_at": time.Now(),
+		}})
+		if err == nil {
+			err = jobKinds[job.Kind].Dead(job.Key)
+		}
+	} else {
+		err = c.Update(mine, bson.M{"$set": bson.M{
+			"state":      jobQueued,
+			"run_at":     time.Now().Add(jobBackoff(job.Attempts)),
+			"last_error": runErr.Error(),
+			"updated_at": time.Now(),
+		}})
+	}
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// jobBackoff is how long to wait before the next attempt of a job that
+// failed the given number of times.
+func jobBackoff(attempts int) time.Duration {
+	delay := jobRetryDelay
+	for i := 1; i < attempts && delay < jobMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > jobMaxRetryDelay {
+		delay = jobMaxRetryDelay
+	}
+	return delay
+}
+
+// run runs job, turning a panic, such as from a decoder fed a broken file,
+// into an error.
+func (queue *JobQueue) run(job *Job) (err error) {
+	kind, ok := jobKinds[job.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return kind.Run(job.Key)
+}
+
+func (queue *JobQueue) work() {
+	for {
+		job, err := queue.claim()
+		if err != nil {
+			log.Printf("Error claiming job: %s", err)
+		}
+		if job == nil {
+			select {
+			case <-queue.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		runErr := queue.run(job)
+		if runErr != nil {
+			log.Printf("Job %s failed on attempt %d: %s", job.ID, job.Attempts, runErr)
+		}
+		err = queue.finish(job, runErr)
+		if err != nil {
+			log.Printf("Error finishing job %s: %s", job.ID, err)
+		}
+	}
+}
+
+// StartJobWorkers starts config.ProcessingWorkers workers running queued
+// jobs.
+func StartJobWorkers() {
+	for i := 0; i < config.ProcessingWorkers; i++ {
+		go globalJobQueue.work()
+	}
+}
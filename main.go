@@ -3,20 +3,49 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-func init() {
+// initStores connects to everything the app keeps its data in. It runs from
+// main rather than init, so tests can do without a database.
+func initStores() {
+	initImageStores()
 	// Assign a user store
 	InitUserStore()
 	// Assign session store
 	InitSessionStore()
-	// Assign mongoDB
+	// Open the cache of on-demand transformations
+	InitTransformCache()
+	// Prepare the queue renditions are generated from
+	InitJobQueue()
+	// Prepare the store of resumable uploads
+	InitUploads()
+}
+
+// initImageStores connects to what images and their files are kept in, and
+// no more. Maintenance commands run next to a live server, so they leave the
+// file stores it holds locked alone.
+func initImageStores() {
+	// Assign mongoDB, the stores below may depend on it
 	InitMongoDB()
+	// Assign blob store for image files
+	InitBlobStore()
+	// Prepare the image collection
+	InitImageStore()
+	// Load and check the renditions generated for every image
+	InitRenditions()
 }
 
 func main() {
+	// Maintenance commands, as in `gophr renditions rebuild`
+	if len(os.Args) > 1 && os.Args[1] == "renditions" {
+		initImageStores()
+		os.Exit(RunRenditionsCommand(os.Args[2:]))
+	}
+
+	initStores()
 
 	addr := ":3000"
 	router := NewRouter()
@@ -27,10 +56,13 @@ func main() {
 	router.Handle("GET", "/login", HandleSessionNew)
 	router.Handle("POST", "/login", HandleSessionCreate)
 	router.Handle("GET", "/image/:imageID", HandleImageShow)
+	router.Handle("GET", "/image/:imageID/status", HandleImageStatus)
+	router.Handle("GET", "/image/:imageID/events", HandleImageEvents)
 	router.Handle("GET", "/user/:userID", HandleUserShow)
+	router.Handle("GET", "/search", HandleSearch)
 
 	router.ServeFiles("/assets/*filepath", http.Dir("assets/"))
-	router.ServeFiles("/im/*filepath", http.Dir("data/images/"))
+	router.Handle("GET", "/im/*filepath", HandleImageFile)
 
 	secureRouter := NewRouter()
 	secureRouter.Handle("GET", "/sign-out", HandleSessionDestroy)
@@ -38,6 +70,22 @@ func main() {
 	secureRouter.Handle("POST", "/account", HandleUserUpdate)
 	secureRouter.Handle("GET", "/images/new", HandleImageNew)
 	secureRouter.Handle("POST", "/images/new", HandleImageCreate)
+	secureRouter.Handle("GET", "/image/:imageID/edit", HandleImageEdit)
+	secureRouter.Handle("POST", "/image/:imageID/edit", HandleImageUpdate)
+	secureRouter.Handle("GET", "/image/:imageID/adjust", HandleImageAdjust)
+	secureRouter.Handle("POST", "/image/:imageID/adjust", HandleImageAdjustUpdate)
+	secureRouter.Handle("POST", "/image/:imageID/revert", HandleImageRevert)
+	secureRouter.Handle("POST", "/image/:imageID/focus", HandleImageFocus)
+	secureRouter.Handle("POST", "/image/:imageID/retry", HandleImageRetry)
+	secureRouter.Handle("POST", "/image/:imageID/delete", HandleImageDestroy)
+	secureRouter.Handle("POST", "/image/:imageID/restore", HandleImageRestore)
+	secureRouter.Handle("POST", "/image/:imageID/purge", HandleImagePurge)
+	secureRouter.Handle("GET", "/trash", HandleTrash)
+	secureRouter.Handle("OPTIONS", "/uploads", HandleUploadOptions)
+	secureRouter.Handle("POST", "/uploads", HandleUploadCreate)
+	secureRouter.Handle("HEAD", "/uploads/:uploadID", HandleUploadHead)
+	secureRouter.Handle("PATCH", "/uploads/:uploadID", HandleUploadPatch)
+	secureRouter.Handle("DELETE", "/uploads/:uploadID", HandleUploadDelete)
 
 	notFoundRouter := NewRouterCustom()
 
@@ -47,6 +95,10 @@ func main() {
 	middleware.Add(secureRouter)
 	middleware.Add(notFoundRouter)
 
+	StartTrashPurger()
+	StartUploadPurger()
+	StartJobWorkers()
+
 	log.Fatal(http.ListenAndServe(addr, middleware))
 
 	defer CloseMongoDBSession(mongoSession)
@@ -19,6 +19,14 @@ func (w *MiddlewareResponseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Flush sends what was written so far, for handlers that stream.
+func (w *MiddlewareResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.written = true
+		flusher.Flush()
+	}
+}
+
 func NewMiddlewareResponseWriter(w http.ResponseWriter) *MiddlewareResponseWriter {
 	return &MiddlewareResponseWriter{
 		ResponseWriter: w,
@@ -2,14 +2,10 @@ package main
 
 import mgo "gopkg.in/mgo.v2"
 
-const (
-	host = "localhost"
-)
-
 var mongoSession *mgo.Session
 
 func InitMongoDB() {
-	db, err := NewMongoDBSession(host)
+	db, err := NewMongoDBSession(config.MongoHost)
 	if err != nil {
 		panic(err)
 	}
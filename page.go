@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const maxPageSize = 100
+
+var errInvalidCursor = errors.New("invalid page cursor")
+
+// Page asks for one page of a stream of images, newest first. After and
+// Before are cursors from an earlier ImagePage, and at most one is set.
+//
+// A cursor points at an image by its created_at and _id, so a page is found
+// through the index however deep it is, rather than by skipping over
+// everything before it.
+type Page struct {
+	After  string
+	Before string
+	Size   int
+}
+
+// ImagePage is one page of images, with cursors to the pages either side.
+type ImagePage struct {
+	Images []Image
+	Next   string // older images, empty on the last page
+	Prev   string // newer images, empty on the first page
+	Size   int
+	Path   string // where the stream is shown, for building links
+}
+
+// RequestPage reads the page a request asks for from its after, before and
+// size query parameters.
+func RequestPage(r *http.Request) Page {
+	query := r.URL.Query()
+	page := Page{
+		After:  query.Get("after"),
+		Before: query.Get("before"),
+		Size:   pageSize,
+	}
+	if size, err := strconv.Atoi(query.Get("size")); err == nil {
+		page.Size = size
+	}
+	if page.Size < 1 {
+		page.Size = 1
+	}
+	if page.Size > maxPageSize {
+		page.Size = maxPageSize
+	}
+	return page
+}
+
+func encodeCursor(image *Image) string {
+	cursor := fmt.Sprintf("%d:%s", image.CreatedAt.UnixNano(), image.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", errInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	return time.Unix(0, nanos), parts[1], nil
+}
+
+// pageQuery adds the conditions for page to query, and returns the sort
+// order to apply. Pages before a cursor are read oldest first, so the
+// results have to be reversed.
+func pageQuery(query bson.M, page Page) ([]string, error) {
+	cursor, op, sort := page.After, "$lt", []string{"-created_at", "-_id"}
+	if page.Before != "" {
+		cursor, op, sort = page.Before, "$gt", []string{"created_at", "_id"}
+	}
+	if cursor == "" {
+		return sort, nil
+	}
+
+	createdAt, id, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	query["$or"] = []bson.M{
+		{"created_at": bson.M{op: createdAt}},
+		{"created_at": createdAt, "_id": bson.M{op: id}},
+	}
+	return sort, nil
+}
+
+// newImagePage works out the cursors for a page from the results of a
+// query made with pageQuery, which asked for one image more than fits.
+func newImagePage(images []Image, page Page) *ImagePage {
+	more := len(images) > page.Size
+	if more {
+		images = images[:page.Size]
+	}
+	if page.Before != "" {
+		for i, j := 0, len(images)-1; i < j; i, j = i+1, j-1 {
+			images[i], images[j] = images[j], images[i]
+		}
+	}
+
+	result := &ImagePage{
+		Images: images,
+		Size:   page.Size,
+	}
+	if len(images) == 0 {
+		return result
+	}
+
+	first, last := &images[0], &images[len(images)-1]
+	if page.Before != "" {
+		// There is at least the image we came from after this page
+		result.Next = encodeCursor(last)
+		if more {
+			result.Prev = encodeCursor(first)
+		}
+	} else {
+		if more {
+			result.Next = encodeCursor(last)
+		}
+		if page.After != "" {
+			result.Prev = encodeCursor(first)
+		}
+	}
+	return result
+}
+
+func (page *ImagePage) pageURL(key, cursor string) string {
+	query := url.Values{}
+	query.Set(key, cursor)
+	if page.Size != pageSize {
+		query.Set("size", strconv.Itoa(page.Size))
+	}
+	return page.Path + "?" + query.Encode()
+}
+
+// NextURL links to the page of older images, or is empty on the last page.
+func (page *ImagePage) NextURL() string {
+	if page.Next == "" {
+		return ""
+	}
+	return page.pageURL("after", page.Next)
+}
+
+// PrevURL links to the page of newer images, or is empty on the first page.
+func (page *ImagePage) PrevURL() string {
+	if page.Prev == "" {
+		return ""
+	}
+	return page.pageURL("before", page.Prev)
+}
+
+// SizeChoices lists the page sizes offered in the templates.
+func (page *ImagePage) SizeChoices() []int {
+	return []int{pageSize, 2 * pageSize, maxPageSize}
+}
+
+type imageJSON struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	URL         string    `json:"url"`
+	Thumbnail   string    `json:"thumbnail"`
+	Preview     string    `json:"preview"`
+	Status      string    `json:"status,omitempty"`
+}
+
+type imagePageJSON struct {
+	Images []imageJSON `json:"images"`
+	Next   string      `json:"next,omitempty"`
+	Prev   string      `json:"prev,omitempty"`
+}
+
+// RenderImagePageJSON writes page as JSON, for clients that load more
+// images as the user scrolls. The next and prev links return JSON as well.
+func RenderImagePageJSON(w http.ResponseWriter, page *ImagePage) {
+	out := imagePageJSON{
+		Images: []imageJSON{},
+	}
+	for i := range page.Images {
+		image := &page.Images[i]
+		out.Images = append(out.Images, imageJSON{
+			ID:          image.ID,
+			UserID:      image.UserID,
+			Name:        image.Name,
+			Description: image.Description,
+			CreatedAt:   image.CreatedAt,
+			URL:         image.ShowRoute(),
+			Thumbnail:   image.StaticThumbnailRoute(),
+			Preview:     image.StaticPreviewRoute(),
+			Status:      image.Status,
+		})
+	}
+	if next := page.NextURL(); next != "" {
+		out.Next = next + "&format=json"
+	}
+	if prev := page.PrevURL(); prev != "" {
+		out.Prev = prev + "&format=json"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(out)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	image := &Image{
+		ID:        "img_abc:def",
+		CreatedAt: time.Date(2016, 3, 1, 12, 30, 0, 123456789, time.UTC),
+	}
+	createdAt, id, err := decodeCursor(encodeCursor(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !createdAt.Equal(image.CreatedAt) || id != image.ID {
+		t.Errorf("decoded %s %q, want %s %q", createdAt, id, image.CreatedAt, image.ID)
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	encode := base64.RawURLEncoding.EncodeToString
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "not a cursor!"},
+		{"padded", base64.URLEncoding.EncodeToString([]byte("1:img_a"))},
+		{"no separator", encode([]byte("1456835400"))},
+		{"no time", encode([]byte(":img_a"))},
+		{"time not a number", encode([]byte("yesterday:img_a"))},
+	}
+	for _, test := range tests {
+		_, _, err := decodeCursor(test.cursor)
+		if err != errInvalidCursor {
+			t.Errorf("%s: error = %v, want errInvalidCursor", test.name, err)
+		}
+	}
+}
+
+func TestRequestPageSize(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", pageSize},
+		{"size=10", 10},
+		{"size=0", 1},
+		{"size=-5", 1},
+		{"size=1000", maxPageSize},
+		{"size=ten", pageSize},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/?"+test.query, nil)
+		if page := RequestPage(r); page.Size != test.want {
+			t.Errorf("%q: size %d, want %d", test.query, page.Size, test.want)
+		}
+	}
+}
+
+func TestNewImagePage(t *testing.T) {
+	// Newest first, as a stream shows them
+	all := make([]Image, 5)
+	for i := range all {
+		all[i] = Image{
+			ID:        "img_" + strconv.Itoa(i),
+			CreatedAt: time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC).Add(-time.Duration(i) * time.Hour),
+		}
+	}
+	cursor := func(i int) string {
+		return encodeCursor(&all[i])
+	}
+	// rows returns the images at indexes, as the query finds them
+	rows := func(indexes ...int) []Image {
+		images := []Image{}
+		for _, i := range indexes {
+			images = append(images, all[i])
+		}
+		return images
+	}
+
+	tests := []struct {
+		name       string
+		rows       []Image
+		page       Page
+		want       []Image
+		next, prev string
+	}{
+		{
+			name: "empty",
+			rows: rows(),
+			page: Page{Size: 2},
+			want: rows(),
+		},
+		{
+			name: "first page of one",
+			rows: rows(0, 1),
+			page: Page{Size: 2},
+			want: rows(0, 1),
+		},
+		{
+			name: "first page of more",
+			rows: rows(0, 1, 2),
+			page: Page{Size: 2},
+			want: rows(0, 1),
+			next: cursor(1),
+		},
+		{
+			name: "after, more to come",
+			rows: rows(2, 3, 4),
+			page: Page{After: cursor(1), Size: 2},
+			want: rows(2, 3),
+			next: cursor(3),
+			prev: cursor(2),
+		},
+		{
+			name: "after, last page",
+			rows: rows(3, 4),
+			page: Page{After: cursor(2), Size: 2},
+			want: rows(3, 4),
+			prev: cursor(3),
+		},
+		{
+			// Read oldest first, so the page is reversed
+			name: "before, more to come",
+			rows: rows(2, 1, 0),
+			page: Page{Before: cursor(3), Size: 2},
+			want: rows(1, 2),
+			next: cursor(2),
+			prev: cursor(1),
+		},
+		{
+			name: "before, first page",
+			rows: rows(1, 0),
+			page: Page{Before: cursor(2), Size: 2},
+			want: rows(0, 1),
+			next: cursor(1),
+		},
+	}
+	for _, test := range tests {
+		result := newImagePage(test.rows, test.page)
+		if !reflect.DeepEqual(result.Images, test.want) {
+			t.Errorf("%s: images %v, want %v", test.name, imageIDs(result.Images), imageIDs(test.want))
+		}
+		if result.Next != test.next || result.Prev != test.prev {
+			t.Errorf("%s: next %q prev %q, want %q %q", test.name, result.Next, result.Prev, test.next, test.prev)
+		}
+		if result.Size != test.page.Size {
+			t.Errorf("%s: size %d, want %d", test.name, result.Size, test.page.Size)
+		}
+	}
+}
+
+func imageIDs(images []Image) []string {
+	ids := []string{}
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+	return ids
+}
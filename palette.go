@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var errInvalidColor = errors.New("invalid color, expected one like #ff8800")
+
+const (
+	paletteSize       = 5
+	paletteSampleSize = 64 // pixels a side of the copy colours are taken from
+	paletteIterations = 10
+	// Palette colours are indexed by the bin of Lab space they fall in
+	paletteBinL  = 10.0
+	paletteBinAB = 20.0
+	// Colours further apart than this don't match in a search. A distance
+	// of about 2.3 is the smallest difference people notice.
+	colorSearchDistance = 20.0
+	// Most images with a colour in a nearby bin whose palettes are compared
+	// in a search
+	colorCandidateLimit = 2000
+)
+
+// PaletteColor is one of the dominant colours of an image, with the share of
+// the image it covers.
+type PaletteColor struct {
+	Hex    string  `bson:"hex"`
+	Weight float64 `bson:"weight"`
+	L      float64 `bson:"l"`
+	A      float64 `bson:"a"`
+	B      float64 `bson:"b"`
+}
+
+// labColor is a colour in CIE L*a*b*, where distances match how different
+// colours look far better than in RGB.
+type labColor struct {
+	L, A, B float64
+}
+
+func (c labColor) distance(other labColor) float64 {
+	return math.Sqrt((c.L-other.L)*(c.L-other.L) + (c.A-other.A)*(c.A-other.A) + (c.B-other.B)*(c.B-other.B))
+}
+
+// rgbToLab converts an sRGB colour to L*a*b* under the D65 white point.
+func rgbToLab(r, g, b uint8) labColor {
+	linear := func(c uint8) float64 {
+		v := float64(c) / 255
+		if v <= 0.04045 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	rl, gl, bl := linear(r), linear(g), linear(b)
+
+	x := (0.4124*rl + 0.3576*gl + 0.1805*bl) / 0.95047
+	y := 0.2126*rl + 0.7152*gl + 0.0722*bl
+	z := (0.0193*rl + 0.1192*gl + 0.9505*bl) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return labColor{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// labToHex converts back to sRGB, for showing a colour.
+func labToHex(c labColor) string {
+	fy := (c.L + 16) / 116
+	fx := fy + c.A/500
+	fz := fy - c.B/200
+	finv := func(t float64) float64 {
+		if t*t*t > 216.0/24389 {
+			return t * t * t
+		}
+		return (116*t - 16) / (24389.0 / 27)
+	}
+	x, y, z := finv(fx)*0.95047, finv(fy), finv(fz)*1.08883
+
+	gamma := func(v float64) uint8 {
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		return uint8(math.Max(0, math.Min(255, v*255+0.5)))
+	}
+	r := gamma(3.2406*x - 1.5372*y - 0.4986*z)
+	g := gamma(-0.9689*x + 1.8758*y + 0.0415*z)
+	b := gamma(0.0557*x - 0.2040*y + 1.0570*z)
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+// ParseHexColor reads a colour written as #rrggbb.
+func ParseHexColor(s string) (labColor, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return labColor{}, errInvalidColor
+	}
+	value, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return labColor{}, errInvalidColor
+	}
+	return rgbToLab(uint8(value>>16), uint8(value>>8), uint8(value)), nil
+}
+
+// ExtractPalette finds the dominant colours of img with k-means clustering
+// in Lab space, over a small copy of the image. The clusters start out as
+// bands of luminance taken from the image's histogram, so the result is the
+// same every time.
+func ExtractPalette(img image.Image) []PaletteColor {
+	small := imaging.Fit(img, paletteSampleSize, paletteSampleSize, imaging.Box)
+	histogram := imaging.Histogram(small)
+
+	// Luminance at which each starting cluster ends
+	var bounds [paletteSize]int
+	cumulative, band := 0.0, 0
+	for i, share := range histogram {
+		cumulative += share
+		for band < paletteSize && cumulative >= float64(band+1)/paletteSize {
+			bounds[band] = i
+			band++
+		}
+	}
+
+	var pixels []labColor
+	var assignments []int
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		// Transparent parts have no colour to speak of
+		if small.Pix[i+3] < 128 {
+			continue
+		}
+		r, g, b := small.Pix[i], small.Pix[i+1], small.Pix[i+2]
+		pixels = append(pixels, rgbToLab(r, g, b))
+
+		luminance := int(0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b) + 0.5)
+		cluster := 0
+		for cluster < paletteSize-1 && luminance > bounds[cluster] {
+			cluster++
+		}
+		assignments = append(assignments, cluster)
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	var centers [paletteSize]labColor
+	var counts [paletteSize]int
+	for iteration := 0; iteration < paletteIterations; iteration++ {
+		// Move each center to the mean of its pixels
+		var sums [paletteSize]labColor
+		counts = [paletteSize]int{}
+		for i, pixel := range pixels {
+			cluster := assignments[i]
+			sums[cluster].L += pixel.L
+			sums[cluster].A += pixel.A
+			sums[cluster].B += pixel.B
+			counts[cluster]++
+		}
+		for cluster := range centers {
+			if counts[cluster] > 0 {
+				n := float64(counts[cluster])
+				centers[cluster] = labColor{sums[cluster].L / n, sums[cluster].A / n, sums[cluster].B / n}
+			}
+		}
+
+		// Then each pixel to its nearest center
+		changed := false
+		for i, pixel := range pixels {
+			nearest, best := assignments[i], math.MaxFloat64
+			for cluster, center := range centers {
+				if counts[cluster] == 0 {
+					continue
+				}
+				if d := pixel.distance(center); d < best {
+					nearest, best = cluster, d
+				}
+			}
+			if nearest != assignments[i] {
+				assignments[i] = nearest
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	counts = [paletteSize]int{}
+	for _, cluster := range assignments {
+		counts[cluster]++
+	}
+	palette := []PaletteColor{}
+	for cluster, center := range centers {
+		if counts[cluster] == 0 {
+			continue
+		}
+		palette = append(palette, PaletteColor{
+			Hex:    labToHex(center),
+			Weight: float64(counts[cluster]) / float64(len(pixels)),
+			L:      center.L,
+			A:      center.A,
+			B:      center.B,
+		})
+	}
+	sort.Sort(byWeight(palette))
+	return palette
+}
+
+type byWeight []PaletteColor
+
+func (palette byWeight) Len() int           { return len(palette) }
+func (palette byWeight) Less(i, j int) bool { return palette[i].Weight > palette[j].Weight }
+func (palette byWeight) Swap(i, j int)      { palette[i], palette[j] = palette[j], palette[i] }
+
+// SearchRoute finds other images with this colour.
+func (c *PaletteColor) SearchRoute() string {
+	return "/search?" + url.Values{"color": {c.Hex}}.Encode()
+}
+
+func (c *PaletteColor) lab() labColor {
+	return labColor{c.L, c.A, c.B}
+}
+
+// paletteBin is the key of a bin of Lab space, as images are indexed by.
+func paletteBin(l, a, b int) string {
+	return fmt.Sprintf("%d:%d:%d", l, a, b)
+}
+
+func paletteBinOf(c labColor) (int, int, int) {
+	return int(math.Floor(c.L / paletteBinL)), int(math.Floor(c.A / paletteBinAB)), int(math.Floor(c.B / paletteBinAB))
+}
+
+// paletteBins lists the bins of every colour in palette, which is what
+// images are indexed by for searching.
+func paletteBins(palette []PaletteColor) []string {
+	bins := []string{}
+	seen := map[string]bool{}
+	for i := range palette {
+		bin := paletteBin(paletteBinOf(palette[i].lab()))
+		if !seen[bin] {
+			seen[bin] = true
+			bins = append(bins, bin)
+		}
+	}
+	return bins
+}
+
+// nearPaletteBins lists the bins of c and those next to it, which hold
+// every colour within colorSearchDistance of c.
+func nearPaletteBins(c labColor) []string {
+	l, a, b := paletteBinOf(c)
+	reachL := int(math.Ceil(colorSearchDistance / paletteBinL))
+	reachAB := int(math.Ceil(colorSearchDistance / paletteBinAB))
+
+	bins := []string{}
+	for dl := -reachL; dl <= reachL; dl++ {
+		for da := -reachAB; da <= reachAB; da++ {
+			for db := -reachAB; db <= reachAB; db++ {
+				bins = append(bins, paletteBin(l+dl, a+da, b+db))
+			}
+		}
+	}
+	return bins
+}
+
+// setPalette records the dominant colours of the image.
+func (image *Image) setPalette(palette []PaletteColor) {
+	image.Palette = palette
+	image.PaletteBins = paletteBins(palette)
+}
+
+// colorMatch is how well an image matches a colour: the distance to the
+// nearest colour of its palette, less for colours that cover more of it.
+func (image *Image) colorMatch(c labColor) (float64, bool) {
+	best, found := math.MaxFloat64, false
+	for i := range image.Palette {
+		distance := image.Palette[i].lab().distance(c)
+		if distance > colorSearchDistance {
+			continue
+		}
+		score := distance * (1.5 - image.Palette[i].Weight)
+		if score < best {
+			best, found = score, true
+		}
+	}
+	return best, found
+}
+
+type colorResult struct {
+	image Image
+	score float64
+}
+
+type byScore []colorResult
+
+func (results byScore) Len() int           { return len(results) }
+func (results byScore) Less(i, j int) bool { return results[i].score < results[j].score }
+func (results byScore) Swap(i, j int)      { results[i], results[j] = results[j], results[i] }
+
+// FindByColor returns up to limit images with a colour close to c in their
+// palette, best matches first. Only the palettes of the candidates are
+// loaded, at most colorCandidateLimit of them, and then the images found.
+func (store *DBImageStore) FindByColor(c labColor, limit int) ([]Image, error) {
+	query := bson.M{
+		"palette_bins": bson.M{"$in": nearPaletteBins(c)},
+		"deleted_at":   nil,
+	}
+	var candidates []Image
+	err := store.Session.DB(dbName).C(collectionName).Find(query).Select(bson.M{"_id": 1, "palette": 1}).Limit(colorCandidateLimit).All(&candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []colorResult{}
+	for _, candidate := range candidates {
+		if score, ok := candidate.colorMatch(c); ok {
+			results = append(results, colorResult{candidate, score})
+		}
+	}
+	sort.Stable(byScore(results))
+
+	ids := []string{}
+	for i := 0; i < len(results) && i < limit; i++ {
+		ids = append(ids, results[i].image.ID)
+	}
+	found, err := store.findByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	images := []Image{}
+	for _, id := range ids {
+		// Unless it was deleted in the meantime
+		if image, ok := found[id]; ok {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A perceptual hash is 64 bits, and is indexed as phashBands bands of 8 bits.
+// Two hashes within phashBands-1 bits of each other share at least one
+// band, so a lookup by band finds every image that near.
+const (
+	phashBands = 8
+	// Hashes this close are of the same picture, give or take re-encoding
+	// and resizing
+	duplicateDistance = 2
+	similarImageLimit = 8
+	// Most images sharing a band with the hash that are compared with it.
+	// Pictures as plain as a white page share bands with a great many.
+	phashCandidateLimit = 1000
+)
+
+// PerceptualHash computes the dHash of img: the image is shrunk to 9x8
+// grey pixels, and each bit tells whether a pixel is brighter than its
+// right-hand neighbour. Unlike a digest of the bytes it barely changes when
+// an image is resized, re-encoded or slightly edited.
+func PerceptualHash(img image.Image) uint64 {
+	small := imaging.Resize(img, 9, 8, imaging.Box)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if luminance(small, x, y) > luminance(small, x+1, y) {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+func luminance(img *image.NRGBA, x, y int) float64 {
+	i := img.PixOffset(x, y)
+	return 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+}
+
+// phashString is how a hash is stored, as 16 hex digits.
+func phashString(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parsePHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// phashBandKeys splits a stored hash into the keys it's indexed under, such
+// as "3:a7" for band 3.
+func phashBandKeys(s string) []string {
+	keys := []string{}
+	for band := 0; band < phashBands && len(s) >= band*2+2; band++ {
+		keys = append(keys, fmt.Sprintf("%d:%s", band, s[band*2:band*2+2]))
+	}
+	return keys
+}
+
+// hammingDistance counts the bits two hashes differ in.
+func hammingDistance(a, b uint64) int {
+	distance := 0
+	for x := a ^ b; x != 0; x &= x - 1 {
+		distance++
+	}
+	return distance
+}
+
+// setPHash records the perceptual hash of the image.
+func (image *Image) setPHash(hash string) {
+	image.PHash = hash
+	image.PHashBands = phashBandKeys(hash)
+}
+
+// similarImage is an image found near another, with how near.
+type similarImage struct {
+	Image    Image
+	Distance int
+}
+
+type byDistance []similarImage
+
+func (images byDistance) Len() int           { return len(images) }
+func (images byDistance) Less(i, j int) bool { return images[i].Distance < images[j].Distance }
+func (images byDistance) Swap(i, j int)      { images[i], images[j] = images[j], images[i] }
+
+// findNear returns up to limit images matching query whose hash is within
+// maxDistance of hash, nearest first. Only the hashes of the candidates are
+// loaded, at most phashCandidateLimit of them, and then the images found.
+func (store *DBImageStore) findNear(query bson.M, hash string, maxDistance, limit int) ([]similarImage, error) {
+	target, err := parsePHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	query["phash_bands"] = bson.M{"$in": phashBandKeys(hash)}
+	query["deleted_at"] = nil
+
+	var candidates []Image
+	err = store.Session.DB(dbName).C(collectionName).Find(query).Select(bson.M{"_id": 1, "phash": 1}).Limit(phashCandidateLimit).All(&candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	near := []similarImage{}
+	for _, candidate := range candidates {
+		other, err := parsePHash(candidate.PHash)
+		if err != nil {
+			continue
+		}
+		if distance := hammingDistance(target, other); distance <= maxDistance {
+			near = append(near, similarImage{candidate, distance})
+		}
+	}
+	sort.Stable(byDistance(near))
+	if len(near) > limit {
+		near = near[:limit]
+	}
+
+	ids := []string{}
+	for _, image := range near {
+		ids = append(ids, image.Image.ID)
+	}
+	byID, err := store.findByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	found := []similarImage{}
+	for _, image := range near {
+		// Unless it was deleted in the meantime
+		if full, ok := byID[image.Image.ID]; ok {
+			found = append(found, similarImage{full, image.Distance})
+		}
+	}
+	return found, nil
+}
+
+// FindSimilar returns up to limit images that look like image, nearest
+// first, leaving out image itself.
+func (store *DBImageStore) FindSimilar(image *Image, limit int) ([]Image, error) {
+	if image.PHash == "" {
+		return nil, nil
+	}
+	// Further than that and the bands no longer find every match
+	maxDistance := config.SimilarImageDistance
+	if maxDistance > phashBands-1 {
+		maxDistance = phashBands - 1
+	}
+	near, err := store.findNear(bson.M{"_id": bson.M{"$ne": image.ID}}, image.PHash, maxDistance, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []Image{}
+	for _, image := range near {
+		images = append(images, image.Image)
+	}
+	return images, nil
+}
+
+// FindDuplicate returns an image of the same user that looks the same as
+// image, if there is one.
+func (store *DBImageStore) FindDuplicate(image *Image) (*Image, error) {
+	if image.PHash == "" {
+		return nil, nil
+	}
+	query := bson.M{
+		"_id":     bson.M{"$ne": image.ID},
+		"user_id": image.UserID,
+	}
+	near, err := store.findNear(query, image.PHash, duplicateDistance, 1)
+	if err != nil || len(near) == 0 {
+		return nil, err
+	}
+	return &near[0].Image, nil
+}
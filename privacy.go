@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// How much of the metadata of a user's originals is served under /im/
+const (
+	metadataKeep          = "keep"
+	metadataStripLocation = "strip_location"
+	metadataStripAll      = "strip_all"
+)
+
+// The policy of users who never chose one
+const defaultMetadataPolicy = metadataStripLocation
+
+// Policies from the most lenient to the strictest
+var metadataPolicyRank = map[string]int{
+	metadataKeep:          0,
+	metadataStripLocation: 1,
+	metadataStripAll:      2,
+}
+
+const (
+	earthRadius          = 6371000 // in m
+	maxPrivacyZones      = 20
+	maxPrivacyZoneRadius = 50000
+)
+
+// PrivacyZone is a circle around a point, such as a user's home. Photos
+// taken inside it never have their location shown.
+type PrivacyZone struct {
+	Name      string  `bson:"name"`
+	Latitude  float64 `bson:"latitude"`
+	Longitude float64 `bson:"longitude"`
+	Radius    float64 `bson:"radius"` // in m
+}
+
+func (zone *PrivacyZone) Validate() error {
+	if zone.Latitude < -90 || zone.Latitude > 90 || zone.Longitude < -180 || zone.Longitude > 180 {
+		return errInvalidPrivacyZone
+	}
+	if zone.Radius <= 0 || zone.Radius > maxPrivacyZoneRadius {
+		return errInvalidPrivacyZone
+	}
+	return nil
+}
+
+// Contains reports whether position lies inside the zone.
+func (zone *PrivacyZone) Contains(position *GPSPosition) bool {
+	return gpsDistance(zone.Latitude, zone.Longitude, position.Latitude, position.Longitude) <= zone.Radius
+}
+
+// gpsDistance is the great-circle distance between two points in metres.
+func gpsDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// MetadataPolicyOrDefault returns the user's choice of metadata policy.
+func (user *User) MetadataPolicyOrDefault() string {
+	if _, ok := metadataPolicyRank[user.MetadataPolicy]; !ok {
+		return defaultMetadataPolicy
+	}
+	return user.MetadataPolicy
+}
+
+// UpdatePrivacy replaces the user's metadata policy and privacy zones.
+func (user *User) UpdatePrivacy(policy string, zones []PrivacyZone) error {
+	if _, ok := metadataPolicyRank[policy]; !ok {
+		return errInvalidMetadataPolicy
+	}
+	if len(zones) > maxPrivacyZones {
+		return errTooManyPrivacyZones
+	}
+	for i := range zones {
+		err := zones[i].Validate()
+		if err != nil {
+			return err
+		}
+	}
+	user.MetadataPolicy = policy
+	user.PrivacyZones = zones
+	return nil
+}
+
+// inPrivacyZone reports whether position lies in any of the user's zones.
+func (user *User) inPrivacyZone(position *GPSPosition) bool {
+	for i := range user.PrivacyZones {
+		if user.PrivacyZones[i].Contains(position) {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataPolicy is how much metadata of the image may be served, given
+// its owner. Photos taken in one of the owner's privacy zones never give
+// away their location.
+func (image *Image) metadataPolicy(owner *User) string {
+	policy := owner.MetadataPolicyOrDefault()
+	if policy == metadataKeep && image.EXIF != nil && image.EXIF.GPS != nil && owner.inPrivacyZone(image.EXIF.GPS) {
+		policy = metadataStripLocation
+	}
+	return policy
+}
+
+// ShowLocation reports whether the image's location may be shown on the
+// site. This method is called by the html template.
+func (image *Image) ShowLocation(owner *User) bool {
+	return image.metadataPolicy(owner) == metadataKeep
+}
+
+// OriginalMetadataPolicy works out how much metadata to leave in the
+// original stored under name. Uploads with the same contents share an
+// original, so the strictest policy of all their owners applies.
+func (store *DBImageStore) OriginalMetadataPolicy(name string) (string, error) {
+	var images []Image
+	err := store.Session.DB(dbName).C(collectionName).Find(bson.M{"location": name}).Select(bson.M{"user_id": 1, "exif": 1}).All(&images)
+	if err != nil {
+		return "", err
+	}
+	if len(images) == 0 {
+		return defaultMetadataPolicy, nil
+	}
+
+	owners := map[string]*User{}
+	policy := metadataKeep
+	for i := range images {
+		owner, ok := owners[images[i].UserID]
+		if !ok {
+			owner, err = globalUserStore.Find(images[i].UserID)
+			if err != nil {
+				return "", err
+			}
+			owners[images[i].UserID] = owner
+		}
+		imagePolicy := defaultMetadataPolicy
+		if owner != nil {
+			imagePolicy = images[i].metadataPolicy(owner)
+		}
+		if metadataPolicyRank[imagePolicy] > metadataPolicyRank[policy] {
+			policy = imagePolicy
+		}
+	}
+	return policy, nil
+}
+
+// IsOriginalBlob reports whether a blob name is that of an original, as
+// opposed to a rendition, which never carries metadata.
+func IsOriginalBlob(name string) bool {
+	return !strings.Contains(strings.TrimPrefix(name, "/"), "/")
+}
+
+// NeedsStripping reports whether metadata has to be stripped from the
+// original stored under name. Only JPEG, TIFF and PNG carry any we know of.
+func NeedsStripping(name, policy string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return policy != metadataKeep && (ext == ".jpg" || ext == ".jpeg" || ext == ".tif" || ext == ".png")
+}
+
+// StripJPEGMetadata copies a JPEG from r to w without the metadata policy
+// rules out. The image data itself is copied untouched.
+//
+// Stripping the location empties the GPS directory of the EXIF block and
+// drops XMP, which may repeat the location. Stripping everything drops EXIF,
+// XMP, IPTC and comments, but keeps the orientation so the image still
+// shows the right way up.
+func StripJPEGMetadata(w io.Writer, r io.Reader, policy string) error {
+	br := bufio.NewReader(r)
+	soi := make([]byte, 2)
+	_, err := io.ReadFull(br, soi)
+	if err != nil {
+		return err
+	}
+	if soi[0] != 0xFF || soi[1] != 0xD8 {
+		return errInvalidImageType
+	}
+	_, err = w.Write(soi)
+	if err != nil {
+		return err
+	}
+
+	for {
+		marker := make([]byte, 2)
+		_, err = io.ReadFull(br, marker)
+		if err != nil {
+			return err
+		}
+		if marker[0] != 0xFF {
+			return errInvalidImageType
+		}
+		if marker[1] == 0xFF {
+			br.UnreadByte()
+			continue
+		}
+		// Markers without a segment
+		if marker[1] == 0x01 || (marker[1] >= 0xD0 && marker[1] <= 0xD9) {
+			_, err = w.Write(marker)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var length uint16
+		err = binary.Read(br, binary.BigEndian, &length)
+		if err != nil {
+			return err
+		}
+		if length < 2 {
+			return errInvalidImageType
+		}
+		segment := make([]byte, length-2)
+		_, err = io.ReadFull(br, segment)
+		if err != nil {
+			return err
+		}
+
+		// Start of scan, everything after it is image data
+		if marker[1] == 0xDA {
+			err = writeJPEGSegment(w, marker[1], segment)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, br)
+			return err
+		}
+
+		segment = stripJPEGSegment(marker[1], segment, policy)
+		if segment != nil {
+			err = writeJPEGSegment(w, marker[1], segment)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeJPEGSegment(w io.Writer, marker byte, segment []byte) error {
+	header := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+	_, err := w.Write(append(header, segment...))
+	return err
+}
+
+// stripJPEGSegment returns what is left of a segment under policy, or nil
+// if it has to go entirely.
+func stripJPEGSegment(marker byte, segment []byte, policy string) []byte {
+	exifHeader := []byte("Exif\x00\x00")
+	isEXIF := marker == 0xE1 && bytes.HasPrefix(segment, exifHeader)
+	// Any other APP1 segment is XMP
+	isXMP := marker == 0xE1 && !isEXIF
+
+	switch policy {
+	case metadataStripLocation:
+		if isXMP {
+			return nil
+		}
+		if isEXIF {
+			block := removeEXIFLocation(segment[len(exifHeader):])
+			if block == nil {
+				return nil
+			}
+			return append(exifHeader, block...)
+		}
+	case metadataStripAll:
+		// APP13 holds IPTC, 0xFE is a comment
+		if isXMP || marker == 0xED || marker == 0xFE {
+			return nil
+		}
+		if isEXIF {
+			exif, err := parseEXIF(segment[len(exifHeader):])
+			if err != nil || exif.Orientation <= 1 {
+				return nil
+			}
+			return append(exifHeader, orientationEXIF(exif.Orientation)...)
+		}
+	}
+	return segment
+}
+
+// StripPNGMetadata copies a PNG from r to w without the metadata policy
+// rules out. The image data itself is copied untouched.
+//
+// Stripping the location empties the GPS directory of the eXIf chunk and
+// drops XMP and the raw EXIF and XMP profiles some tools put in text chunks.
+// Stripping everything drops eXIf, all text chunks and the modification time,
+// but keeps the orientation.
+func StripPNGMetadata(w io.Writer, r io.Reader, policy string) error {
+	br := bufio.NewReader(r)
+	signature := make([]byte, 8)
+	_, err := io.ReadFull(br, signature)
+	if err != nil {
+		return err
+	}
+	if string(signature) != "\x89PNG\r\n\x1a\n" {
+		return errInvalidImageType
+	}
+	_, err = w.Write(signature)
+	if err != nil {
+		return err
+	}
+
+	for {
+		header := make([]byte, 8)
+		_, err = io.ReadFull(br, header)
+		if err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		kind := string(header[4:])
+
+		if !isPNGMetadataChunk(kind) {
+			// Image data and the like, copied as it is with its CRC
+			_, err = w.Write(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(w, br, length+4)
+			if err != nil {
+				return err
+			}
+			if kind == "IEND" {
+				return nil
+			}
+			continue
+		}
+
+		// The length comes from the file, so read no more than is there
+		chunk, err := ioutil.ReadAll(io.LimitReader(br, length+4))
+		if err != nil {
+			return err
+		}
+		if int64(len(chunk)) != length+4 {
+			return io.ErrUnexpectedEOF
+		}
+		data := stripPNGChunk(kind, chunk[:length], policy)
+		if data != nil {
+			err = writePNGChunk(w, kind, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func isPNGMetadataChunk(kind string) bool {
+	switch kind {
+	case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		return true
+	}
+	return false
+}
+
+func writePNGChunk(w io.Writer, kind string, data []byte) error {
+	chunk := make([]byte, 8, 8+len(data)+4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], kind)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	_, err := w.Write(append(chunk, crc...))
+	return err
+}
+
+// stripPNGChunk returns what is left of a metadata chunk under policy, or nil
+// if it has to go entirely.
+func stripPNGChunk(kind string, data []byte, policy string) []byte {
+	// Text chunks start with a keyword ended by a NUL
+	var keyword string
+	if kind == "tEXt" || kind == "zTXt" || kind == "iTXt" {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			keyword = string(data[:i])
+		}
+	}
+
+	switch policy {
+	case metadataStripLocation:
+		if kind == "eXIf" {
+			return removeEXIFLocation(data)
+		}
+		if keyword == "XML:com.adobe.xmp" || strings.HasPrefix(keyword, "Raw profile type") {
+			return nil
+		}
+	case metadataStripAll:
+		if kind == "eXIf" {
+			exif, err := parseEXIF(data)
+			if err != nil || exif.Orientation <= 1 {
+				return nil
+			}
+			return orientationEXIF(exif.Orientation)
+		}
+		return nil
+	}
+	return data
+}
+
+// The XMP field of a TIFF IFD, which may repeat the location
+const tiffTagXMP = 0x02BC
+
+// Fields of a TIFF IFD that describe the picture or its author rather than
+// the image data, and go when stripping everything
+var tiffMetadataTags = []uint16{
+	0x010E, // ImageDescription
+	0x010F, // Make
+	0x0110, // Model
+	0x0131, // Software
+	0x0132, // DateTime
+	0x013B, // Artist
+	tiffTagXMP,
+	0x8298, // Copyright
+	0x83BB, // IPTC
+}
+
+// removeEXIFLocation returns a copy of an EXIF block with its GPS directory
+// emptied, or nil if the block is too broken to tell.
+func removeEXIFLocation(block []byte) []byte {
+	stripped, err := StripTIFFMetadata(block, metadataStripLocation)
+	if err != nil {
+		return nil
+	}
+	return stripped
+}
+
+// StripTIFFMetadata returns a copy of a TIFF structure, a TIFF file or the
+// EXIF block of a JPEG, without the metadata policy rules out. Fields are
+// cleared in place rather than removed, so no offsets change.
+//
+// Stripping the location empties the GPS directory of every IFD and clears
+// XMP. Stripping everything empties the Exif directory as well, and clears
+// the fields in tiffMetadataTags, which leaves the orientation.
+func StripTIFFMetadata(data []byte, policy string) ([]byte, error) {
+	data = append([]byte(nil), data...)
+	tiff, offset, err := newTIFFData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[uint32]bool{}
+	for offset != 0 {
+		if seen[offset] || len(seen) == tiffMaxIFDs {
+			return nil, errInvalidTIFF
+		}
+		seen[offset] = true
+
+		ifd, next, err := tiff.readIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		err = tiff.clearSubIFD(ifd, exifTagGPSIFD)
+		if err != nil {
+			return nil, err
+		}
+		if field, ok := ifd[tiffTagXMP]; ok {
+			zeroBytes(field.Value)
+		}
+		if policy == metadataStripAll {
+			err = tiff.clearSubIFD(ifd, exifTagExifIFD)
+			if err != nil {
+				return nil, err
+			}
+			for _, tag := range tiffMetadataTags {
+				if field, ok := ifd[tag]; ok {
+					zeroBytes(field.Value)
+				}
+			}
+		}
+		offset = next
+	}
+	return data, nil
+}
+
+// orientationEXIF builds an EXIF block with nothing but an orientation.
+func orientationEXIF(orientation int) []byte {
+	block := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1}
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], exifTagOrientation)
+	binary.BigEndian.PutUint16(entry[2:], tiffShort)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], uint16(orientation))
+	block = append(block, entry...)
+	return append(block, 0, 0, 0, 0)
+}
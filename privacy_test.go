@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+const testXMP = "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta><exif:GPSLatitude>52,30N</exif:GPSLatitude></x:xmpmeta>"
+
+func TestNeedsStripping(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   bool
+	}{
+		{"abc.jpg", metadataStripLocation, true},
+		{"abc.JPEG", metadataStripAll, true},
+		{"abc.tif", metadataStripLocation, true},
+		{"abc.png", metadataStripLocation, true},
+		{"abc.jpg", metadataKeep, false},
+		{"abc.gif", metadataStripAll, false},
+		{"abc.bmp", metadataStripAll, false},
+	}
+	for _, test := range tests {
+		if got := NeedsStripping(test.name, test.policy); got != test.want {
+			t.Errorf("NeedsStripping(%q, %q) = %v, want %v", test.name, test.policy, got, test.want)
+		}
+	}
+}
+
+// testJPEG encodes a small JPEG and puts segments, each a marker followed
+// by its contents, right after the start of image.
+func testJPEG(t *testing.T, segments ...[]byte) []byte {
+	encoded := bytes.NewBuffer(nil)
+	err := jpeg.Encode(encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := encoded.Bytes()
+
+	result := bytes.NewBuffer(data[:2:2])
+	for _, segment := range segments {
+		writeJPEGSegment(result, segment[0], segment[1:])
+	}
+	result.Write(data[2:])
+	return result.Bytes()
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	exif := append([]byte("\xE1Exif\x00\x00"), cameraEXIF(binary.BigEndian, tiffLong)...)
+	original := testJPEG(t,
+		exif,
+		[]byte("\xE1"+testXMP),
+		[]byte("\xED"+"Photoshop 3.0\x00IPTC"),
+		[]byte("\xFE"+"Taken at home"),
+	)
+
+	tests := []struct {
+		policy string
+		// What is left of the EXIF block, nil if none is
+		want *ImageEXIF
+		// Whether XMP, IPTC and the comment are still there
+		xmp, iptc, comment bool
+	}{
+		{metadataStripLocation, &ImageEXIF{Make: "Canon", Model: "Canon EOS 5D Mark III", Lens: "Canon EF50mm f/1.8 STM", ISO: 400, Orientation: 6}, false, true, true},
+		{metadataStripAll, &ImageEXIF{Orientation: 6}, false, false, false},
+	}
+	for _, test := range tests {
+		stripped := bytes.NewBuffer(nil)
+		err := StripJPEGMetadata(stripped, bytes.NewReader(original), test.policy)
+		if err != nil {
+			t.Errorf("%s: %s", test.policy, err)
+			continue
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(stripped.Bytes())); err != nil {
+			t.Errorf("%s: the stripped JPEG doesn't decode: %s", test.policy, err)
+		}
+
+		got, err := ReadEXIF(bytes.NewReader(stripped.Bytes()))
+		if err != nil || got == nil {
+			t.Errorf("%s: no EXIF left (%v)", test.policy, err)
+			continue
+		}
+		if got.GPS != nil {
+			t.Errorf("%s: the location is still there", test.policy)
+		}
+		if got.Make != test.want.Make || got.Lens != test.want.Lens || got.ISO != test.want.ISO || got.Orientation != test.want.Orientation {
+			t.Errorf("%s: EXIF left is %+v, want %+v", test.policy, got, test.want)
+		}
+
+		left := stripped.Bytes()
+		if bytes.Contains(left, []byte("xmpmeta")) != test.xmp {
+			t.Errorf("%s: XMP left = %v, want %v", test.policy, !test.xmp, test.xmp)
+		}
+		if bytes.Contains(left, []byte("Photoshop 3.0")) != test.iptc {
+			t.Errorf("%s: IPTC left = %v, want %v", test.policy, !test.iptc, test.iptc)
+		}
+		if bytes.Contains(left, []byte("Taken at home")) != test.comment {
+			t.Errorf("%s: comment left = %v, want %v", test.policy, !test.comment, test.comment)
+		}
+	}
+}
+
+func TestStripJPEGMetadataWithoutOrientation(t *testing.T) {
+	b := newEXIFBuilder(binary.LittleEndian)
+	exif := append([]byte("\xE1Exif\x00\x00"), b.build(b.ascii(exifTagMake, "Canon"))...)
+	stripped := bytes.NewBuffer(nil)
+	err := StripJPEGMetadata(stripped, bytes.NewReader(testJPEG(t, exif)), metadataStripAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing worth keeping, so the whole block goes
+	if bytes.Contains(stripped.Bytes(), []byte("Exif\x00\x00")) {
+		t.Error("an EXIF block is left")
+	}
+}
+
+func TestStripJPEGMetadataInvalid(t *testing.T) {
+	valid := testJPEG(t, []byte("\xFE"+"comment"))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n")},
+		{"cut off in a segment", valid[:10]},
+		{"segment length below 2", []byte("\xFF\xD8\xFF\xFE\x00\x01")},
+		{"garbage between segments", []byte("\xFF\xD8\x00\x00")},
+	}
+	for _, test := range tests {
+		err := StripJPEGMetadata(bytes.NewBuffer(nil), bytes.NewReader(test.data), metadataStripAll)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestStripTIFFMetadata(t *testing.T) {
+	for _, pointerType := range []uint16{tiffLong, tiffIFDType} {
+		b := newEXIFBuilder(binary.LittleEndian)
+		page := func(name string) []exifField {
+			return []exifField{
+				b.ascii(exifTagMake, "Canon"),
+				b.ascii(0x010E, name), // ImageDescription
+				b.short(exifTagOrientation, 8),
+				b.undefined(tiffTagXMP, testXMP),
+				subIFD(exifTagExifIFD, pointerType, b.short(exifTagISO, 400)),
+				subIFD(exifTagGPSIFD, pointerType,
+					b.ascii(exifTagGPSLatitudeRef, "N"),
+					b.rational(exifTagGPSLatitude, 52, 1, 30, 1, 0, 1),
+					b.ascii(exifTagGPSLongitudeRef, "E"),
+					b.rational(exifTagGPSLongitude, 13, 1, 22, 1, 30, 1),
+				),
+			}
+		}
+		latitude := b.rational(exifTagGPSLatitude, 52, 1, 30, 1, 0, 1).Value
+		// Two pages, each with a location of its own
+		first := b.ifd(page("Front door"))
+		second := b.ifd(page("Back door"))
+		b.link(first, second)
+		original := b.data
+
+		tests := []struct {
+			policy      string
+			make        string
+			iso         int
+			description bool
+		}{
+			{metadataStripLocation, "Canon", 400, true},
+			{metadataStripAll, "", 0, false},
+		}
+		for _, test := range tests {
+			stripped, err := StripTIFFMetadata(original, test.policy)
+			if err != nil {
+				t.Errorf("type %d, %s: %s", pointerType, test.policy, err)
+				continue
+			}
+			if len(stripped) != len(original) {
+				t.Errorf("type %d, %s: length changed from %d to %d", pointerType, test.policy, len(original), len(stripped))
+			}
+			// Checked on the bytes too, as the reading below may miss a
+			// directory just as stripping did
+			if bytes.Contains(stripped, latitude) {
+				t.Errorf("type %d, %s: the latitude is still there", pointerType, test.policy)
+			}
+			if bytes.Contains(stripped, []byte("xmpmeta")) {
+				t.Errorf("type %d, %s: XMP is still there", pointerType, test.policy)
+			}
+			if bytes.Contains(stripped, []byte("door")) != test.description {
+				t.Errorf("type %d, %s: description left = %v, want %v", pointerType, test.policy, !test.description, test.description)
+			}
+
+			tiff, offset, _ := newTIFFData(stripped)
+			for offset != 0 {
+				ifd, next, err := tiff.readIFD(offset)
+				if err != nil {
+					t.Fatalf("type %d, %s: %s", pointerType, test.policy, err)
+				}
+				// parseEXIF only reads the first page, so each is read
+				// as if it were first
+				exif := &ImageEXIF{Make: tiff.ascii(ifd, exifTagMake)}
+				if orientation, ok := tiff.uint(ifd, exifTagOrientation, 0); ok {
+					exif.Orientation = int(orientation)
+				}
+				if sub, ok := tiff.uint(ifd, exifTagExifIFD, 0); ok {
+					if exifIFD, _, err := tiff.readIFD(sub); err == nil {
+						exif.readExifIFD(tiff, exifIFD)
+					}
+				}
+				if sub, ok := tiff.uint(ifd, exifTagGPSIFD, 0); ok {
+					if gpsIFD, _, err := tiff.readIFD(sub); err == nil {
+						exif.readGPSIFD(tiff, gpsIFD)
+					}
+				}
+				if exif.GPS != nil {
+					t.Errorf("type %d, %s: the location of the page at %d is still there", pointerType, test.policy, offset)
+				}
+				if exif.Make != test.make || exif.ISO != test.iso || exif.Orientation != 8 {
+					t.Errorf("type %d, %s: page at %d left with %+v", pointerType, test.policy, offset, exif)
+				}
+				offset = next
+			}
+		}
+
+		// The original is left alone
+		if exif, _ := parseEXIF(original); exif == nil || exif.GPS == nil {
+			t.Errorf("type %d: the original was changed", pointerType)
+		}
+	}
+}
+
+func TestStripTIFFMetadataInvalid(t *testing.T) {
+	b := newEXIFBuilder(binary.BigEndian)
+	looped := b.build(b.short(exifTagOrientation, 1))
+	b.link(8, 8)
+	brokenGPS := newEXIFBuilder(binary.BigEndian)
+	pointer := exifField{Tag: exifTagGPSIFD, Type: tiffLong, Count: 1, Value: []byte{0, 0, 0xFF, 0xFF}}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a TIFF", []byte("GIF89a\x00\x00")},
+		{"IFDs in a loop", looped},
+		{"GPS directory out of range", brokenGPS.build(pointer)},
+	}
+	for _, test := range tests {
+		if _, err := StripTIFFMetadata(test.data, metadataStripLocation); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+// testPNG encodes a small PNG and puts chunks, each a type followed by its
+// data, right after the header.
+func testPNG(t *testing.T, chunks ...[]byte) []byte {
+	encoded := bytes.NewBuffer(nil)
+	err := png.Encode(encoded, image.NewGray(image.Rect(0, 0, 8, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := encoded.Bytes()
+
+	// The signature and IHDR, which always comes first
+	headerEnd := 8 + 8 + 13 + 4
+	result := bytes.NewBuffer(data[:headerEnd:headerEnd])
+	for _, chunk := range chunks {
+		writePNGChunk(result, string(chunk[:4]), chunk[4:])
+	}
+	result.Write(data[headerEnd:])
+	return result.Bytes()
+}
+
+// pngChunk returns the data of the first chunk of the given type, or nil.
+func pngChunk(data []byte, kind string) []byte {
+	for offset := 8; offset+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		if offset+12+length > len(data) {
+			return nil
+		}
+		if string(data[offset+4:offset+8]) == kind {
+			return data[offset+8 : offset+8+length]
+		}
+		offset += 12 + length
+	}
+	return nil
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	original := testPNG(t,
+		append([]byte("eXIf"), cameraEXIF(binary.BigEndian, tiffLong)...),
+		[]byte("iTXtXML:com.adobe.xmp\x00\x00\x00\x00\x00"+testXMP[29:]),
+		[]byte("tEXtRaw profile type exif\x00\nexif\n"),
+		[]byte("tEXtComment\x00Taken at home"),
+		[]byte("tIME\x07\xe0\x03\x01\x0c\x1e\x00"),
+	)
+
+	tests := []struct {
+		policy  string
+		want    *ImageEXIF // what is left of eXIf, nil if it has gone
+		comment bool
+		time    bool
+	}{
+		{metadataStripLocation, &ImageEXIF{Make: "Canon", ISO: 400, Orientation: 6}, true, true},
+		{metadataStripAll, &ImageEXIF{Orientation: 6}, false, false},
+	}
+	for _, test := range tests {
+		stripped := bytes.NewBuffer(nil)
+		err := StripPNGMetadata(stripped, bytes.NewReader(original), test.policy)
+		if err != nil {
+			t.Errorf("%s: %s", test.policy, err)
+			continue
+		}
+		left := stripped.Bytes()
+		// The decoder checks every CRC
+		if _, err := png.Decode(bytes.NewReader(left)); err != nil {
+			t.Errorf("%s: the stripped PNG doesn't decode: %s", test.policy, err)
+		}
+
+		exif, err := parseEXIF(pngChunk(left, "eXIf"))
+		if err != nil {
+			t.Errorf("%s: no eXIf left (%v)", test.policy, err)
+		} else if exif.GPS != nil || exif.Make != test.want.Make || exif.ISO != test.want.ISO || exif.Orientation != test.want.Orientation {
+			t.Errorf("%s: eXIf left is %+v, want %+v", test.policy, exif, test.want)
+		}
+		if bytes.Contains(left, []byte("xmpmeta")) || bytes.Contains(left, []byte("Raw profile")) {
+			t.Errorf("%s: XMP or a raw profile is still there", test.policy)
+		}
+		if bytes.Contains(left, []byte("Taken at home")) != test.comment {
+			t.Errorf("%s: comment left = %v, want %v", test.policy, !test.comment, test.comment)
+		}
+		if (pngChunk(left, "tIME") != nil) != test.time {
+			t.Errorf("%s: time left = %v, want %v", test.policy, !test.time, test.time)
+		}
+	}
+}
+
+func TestStripPNGMetadataInvalid(t *testing.T) {
+	valid := testPNG(t, []byte("tEXtComment\x00hello"))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a PNG", []byte("\xFF\xD8\xFF\xE0")},
+		{"cut off in a chunk", valid[:40]},
+		{"no end", valid[:len(valid)-12]},
+		{"chunk longer than the file", append(valid[:33:33], "\x7f\x00\x00\x00tEXtComment\x00"...)},
+	}
+	for _, test := range tests {
+		err := StripPNGMetadata(bytes.NewBuffer(nil), bytes.NewReader(test.data), metadataStripAll)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Images and blobs whose renditions aren't there yet are processing, or
+// failed if generating them gave up. Ready ones have no status.
+const (
+	imageProcessing = "processing"
+	imageFailed     = "failed"
+)
+
+// The job generating the renditions of a blob, keyed by its digest
+const jobRenditions = "renditions"
+
+// Processing reports whether the renditions of the image are still being
+// generated.
+func (image *Image) Processing() bool {
+	return image.Status == imageProcessing
+}
+
+func (image *Image) Failed() bool {
+	return image.Status == imageFailed
+}
+
+func (image *Image) StatusRoute() string {
+	return "/image/" + image.ID + "/status"
+}
+
+func (image *Image) EventsRoute() string {
+	return "/image/" + image.ID + "/events"
+}
+
+func (image *Image) RetryRoute() string {
+	return "/image/" + image.ID + "/retry"
+}
+
+// placeholderURL is shown in place of renditions that aren't there.
+func (image *Image) placeholderURL() string {
+	if image.Failed() {
+		return "/assets/images/failed.svg"
+	}
+	return "/assets/images/processing.svg"
+}
+
+// Retry queues the renditions of an image that failed to process again.
+func (image *Image) Retry() error {
+	if !image.Failed() {
+		return nil
+	}
+	db := NewDBImageStore()
+	defer db.Close()
+
+	err := db.setBlobStatus(image.Digest, imageFailed, imageProcessing)
+	if err != nil {
+		return err
+	}
+	image.Status = imageProcessing
+	return globalJobQueue.Enqueue(jobRenditions, image.Digest)
+}
+
+// setBlobStatus moves the blob with the given digest, and the images using
+// it, from one status to another.
+func (store *DBImageStore) setBlobStatus(digest, from, to string) error {
+	err := store.Session.DB(dbName).C(blobsCollectionName).Update(
+		bson.M{"_id": digest, "status": from},
+		bson.M{"$set": bson.M{"status": to}},
+	)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	_, err = store.Session.DB(dbName).C(collectionName).UpdateAll(
+		bson.M{"digest": digest, "status": from},
+		bson.M{"$set": bson.M{"status": to}},
+	)
+	return err
+}
+
+// generateBlobRenditions is the job generating the renditions of a newly
+// stored blob. They're then passed on to every image waiting for them.
+func generateBlobRenditions(digest string) error {
+	db := NewDBImageStore()
+	defer db.Close()
+
+	blob, err := db.FindBlob(digest)
+	if err != nil {
+		return err
+	}
+	// Every image using it was deleted before it got its turn
+	if blob == nil {
+		return nil
+	}
+
+	// A job queued again by an image saved just as the last one finished
+	// only has to pass the renditions on
+	if blob.Status == imageProcessing {
+		err = db.generateRenditions(blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	var images []Image
+	err = db.Session.DB(dbName).C(collectionName).Find(bson.M{
+		"digest": digest,
+		"status": imageProcessing,
+	}).All(&images)
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		image := &images[i]
+		image.useBlob(blob)
+		// Uploads that weren't hashed yet are checked for duplicates
+		// now, and told about them on their page
+		if !image.DuplicateAllowed {
+			duplicate, err := db.FindDuplicate(image)
+			if err != nil {
+				return err
+			}
+			if duplicate != nil {
+				image.DuplicateOf = duplicate.ID
+			}
+		}
+		err = db.passRenditions(image)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passRenditions records the renditions useBlob gave an image waiting for
+// them. Only those fields are set, so what was changed on the image while
+// it waited, such as its name or moving it to the trash, is kept.
+func (store *DBImageStore) passRenditions(image *Image) error {
+	set, unset := bson.M{}, bson.M{"status": ""}
+	setRenditions(set, unset, "", image.Renditions, image.Posters)
+	set["animated"] = image.Animated
+	set["phash"] = image.PHash
+	set["phash_bands"] = image.PHashBands
+	set["palette"] = image.Palette
+	set["palette_bins"] = image.PaletteBins
+	if image.DuplicateOf != "" {
+		set["duplicate_of"] = image.DuplicateOf
+	}
+	err := store.Session.DB(dbName).C(collectionName).Update(
+		bson.M{"_id": image.ID, "status": imageProcessing},
+		bson.M{"$set": set, "$unset": unset},
+	)
+	if err == mgo.ErrNotFound {
+		// Deleted while it waited
+		return nil
+	}
+	return err
+}
+
+// generateRenditions generates the renditions of blob from its original,
+// and records them.
+func (store *DBImageStore) generateRenditions(blob *ImageBlob) error {
+	source, err := renderBlob(blob)
+	if err != nil {
+		deleteBlobs(source.renditionNames())
+		return err
+	}
+
+	err = store.saveBlobRenditions(blob, source)
+	if err == mgo.ErrNotFound {
+		// The last image using it went away while this ran
+		deleteBlobs(source.renditionNames())
+		return nil
+	}
+	return err
+}
+
+// renderBlob generates every rendition of the original of blob. The image
+// returned holds what was stored, even when that fails part way.
+func renderBlob(blob *ImageBlob) (*Image, error) {
+	// Orientation is part of the metadata, so it's read again
+	source := &Image{Location: blob.Location}
+	err := source.readOriginalMetadata()
+	if err != nil {
+		return source, err
+	}
+	return source, source.CreatedResizedImages()
+}
+
+// saveBlobRenditions records the renditions of source, made by renderBlob,
+// as those of blob. It returns mgo.ErrNotFound if the blob is gone, or was
+// stored again under another name while they were made.
+func (store *DBImageStore) saveBlobRenditions(blob *ImageBlob, source *Image) error {
+	blob.Renditions = source.Renditions
+	blob.Animated = source.Animated
+	blob.Posters = source.Posters
+	blob.PHash = source.PHash
+	blob.Palette = source.Palette
+	blob.Status = ""
+	return store.Session.DB(dbName).C(blobsCollectionName).Update(bson.M{
+		"_id":      blob.Digest,
+		"location": blob.Location,
+	}, bson.M{
+		"$set": bson.M{
+			"renditions": blob.Renditions,
+			"animated":   blob.Animated,
+			"posters":    blob.Posters,
+			"phash":      blob.PHash,
+			"palette":    blob.Palette,
+		},
+		"$unset": bson.M{"status": ""},
+	})
+}
+
+// failBlobRenditions marks the blob with the given digest, and the images
+// waiting for it, as failed once its job gave up.
+func failBlobRenditions(digest string) error {
+	db := NewDBImageStore()
+	defer db.Close()
+	return db.setBlobStatus(digest, imageProcessing, imageFailed)
+}
+
+// readOriginalMetadata reads the metadata of the stored original.
+func (image *Image) readOriginalMetadata() error {
+	original, _, err := globalBlobStore.Get(image.Location)
+	if err != nil {
+		return err
+	}
+	defer original.Close()
+
+	format, err := sniffImageFormat(original)
+	if err != nil {
+		return err
+	}
+	return image.readImageMetadata(original, format)
+}
+
+// renditionNames lists the blobs of the renditions and posters of the
+// image, without the original.
+func (image *Image) renditionNames() []string {
+	names := []string{}
+	for _, name := range image.Renditions {
+		names = append(names, name)
+	}
+	for _, name := range image.Posters {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Rendition modes
+const (
+	// Scale the image down to fit inside Width x Height. With Width or
+	// Height left at 0 the image is scaled to the other one instead.
+	renditionFit = "fit"
+	// Scale and crop the image to exactly Width x Height
+	renditionFill = "fill"
+	// Cut Width x Height out of the middle of the image without scaling
+	renditionCrop = "crop"
+)
+
+// Rendition describes one of the resized versions generated for every
+// image. The list in renditions can be replaced with a JSON file through
+// config.RenditionsFile.
+type Rendition struct {
+	Name    string  `json:"name"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Mode    string  `json:"mode"`
+	Filter  string  `json:"filter"`  // a key of resampleFilters
+	Format  string  `json:"format"`  // "jpeg", "png", "gif", or empty for the format of the original
+	Quality int     `json:"quality"` // JPEG quality, 1 to 100
+	Sharpen float64 `json:"sharpen"` // sigma of a sharpening pass after resizing, 0 for none
+}
+
+var renditions = []Rendition{
+	{Name: "thumbnail", Width: 400, Height: 400, Mode: renditionFill, Filter: "lanczos", Quality: 90},
+	{Name: "preview", Width: 800, Mode: renditionFit, Filter: "lanczos", Quality: 90},
+	{Name: "square", Width: 150, Height: 150, Mode: renditionFill, Filter: "lanczos", Quality: 85, Sharpen: 0.5},
+}
+
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"catmullrom": imaging.CatmullRom,
+	"mitchell":   imaging.MitchellNetravali,
+	"gaussian":   imaging.Gaussian,
+	"lanczos":    imaging.Lanczos,
+}
+
+// A map of rendition formats and their file extension
+var formatExtension = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+}
+
+// A map of file extensions and the format renditions of them are encoded in
+var extensionFormat = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+}
+
+// InitRenditions loads the renditions from config.RenditionsFile, if set,
+// and checks them.
+func InitRenditions() {
+	if config.RenditionsFile != "" {
+		contents, err := ioutil.ReadFile(config.RenditionsFile)
+		if err != nil {
+			panic(fmt.Errorf("Error reading renditions: %s", err))
+		}
+		renditions = nil
+		err = json.Unmarshal(contents, &renditions)
+		if err != nil {
+			panic(fmt.Errorf("Error reading renditions: %s", err))
+		}
+	}
+
+	names := map[string]bool{}
+	for _, rendition := range renditions {
+		err := rendition.validate()
+		if err == nil && names[rendition.Name] {
+			err = fmt.Errorf("the name is used twice")
+		}
+		if err != nil {
+			panic(fmt.Errorf("Invalid rendition %q: %s", rendition.Name, err))
+		}
+		names[rendition.Name] = true
+	}
+}
+
+func (rendition *Rendition) validate() error {
+	if rendition.Name == "" || strings.ContainsAny(rendition.Name, "/.") {
+		return fmt.Errorf("the name must be set and can't contain / or .")
+	}
+	// Paths below /im/img_ are on-demand transformations
+	if strings.HasPrefix(rendition.Name, "img_") {
+		return fmt.Errorf("the name can't start with img_")
+	}
+	if rendition.Width < 0 || rendition.Height < 0 || rendition.Width+rendition.Height == 0 {
+		return fmt.Errorf("needs a width or a height")
+	}
+	if rendition.Mode != renditionFit && (rendition.Width == 0 || rendition.Height == 0) {
+		return fmt.Errorf("%s needs both a width and a height", rendition.Mode)
+	}
+	switch rendition.Mode {
+	case renditionFit, renditionFill, renditionCrop:
+	default:
+		return fmt.Errorf("unknown mode %q", rendition.Mode)
+	}
+	if _, ok := resampleFilters[rendition.Filter]; !ok {
+		return fmt.Errorf("unknown filter %q", rendition.Filter)
+	}
+	if _, ok := formatExtension[rendition.Format]; !ok && rendition.Format != "" {
+		return fmt.Errorf("unknown format %q", rendition.Format)
+	}
+	if rendition.Quality < 0 || rendition.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100")
+	}
+	return nil
+}
+
+// Resize applies the rendition to srcImage. Crops keep focus in view.
+func (rendition *Rendition) Resize(srcImage image.Image, focus FocalPoint) image.Image {
+	filter := resampleFilters[rendition.Filter]
+	width, height := rendition.Width, rendition.Height
+
+	var dstImage *image.NRGBA
+	switch rendition.Mode {
+	case renditionFill:
+		cropped := imaging.Crop(srcImage, focusFill(srcImage.Bounds(), width, height, focus))
+		dstImage = imaging.Resize(cropped, width, height, filter)
+	case renditionCrop:
+		dstImage = imaging.Crop(srcImage, focusWindow(srcImage.Bounds(), width, height, focus))
+	default:
+		if width == 0 || height == 0 {
+			dstImage = imaging.Resize(srcImage, width, height, filter)
+		} else {
+			dstImage = imaging.Fit(srcImage, width, height, filter)
+		}
+	}
+
+	if rendition.Sharpen > 0 {
+		dstImage = imaging.Sharpen(dstImage, rendition.Sharpen)
+	}
+	return dstImage
+}
+
+// format returns the format to encode dstImage, a rendition of the original
+// with the given file name, in.
+func (rendition *Rendition) format(location string, dstImage image.Image) string {
+	if rendition.Format != "" {
+		return rendition.Format
+	}
+	return webFormat(location, dstImage)
+}
+
+// webFormat picks a format browsers can show for an image made from the
+// original with the given file name. That's the format of the original if
+// it is one, and otherwise JPEG, or PNG if the image is transparent.
+func webFormat(location string, img image.Image) string {
+	if format, ok := extensionFormat[strings.ToLower(filepath.Ext(location))]; ok {
+		return format
+	}
+	if opaque, ok := img.(interface {
+		Opaque() bool
+	}); ok && !opaque.Opaque() {
+		return "png"
+	}
+	return "jpeg"
+}
+
+// BlobName returns the name a rendition of an original is stored under in
+// the given format. That is the name of the original below the rendition's
+// name, with an extension added if the rendition has a different format.
+func (rendition *Rendition) BlobName(location, format string) string {
+	name := rendition.Name + "/" + location
+	if extensionFormat[strings.ToLower(filepath.Ext(location))] != format {
+		name += formatExtension[format]
+	}
+	return name
+}
+
+// Generate resizes srcImage, the original stored at location, and stores
+// the result. It returns the name of the new blob.
+func (rendition *Rendition) Generate(srcImage image.Image, focus FocalPoint, location string) (string, error) {
+	dstImage := rendition.Resize(srcImage, focus)
+
+	format := rendition.format(location, dstImage)
+	buf := bytes.NewBuffer(nil)
+	err := encodeImage(buf, dstImage, format, rendition.Quality)
+	if err != nil {
+		return "", err
+	}
+
+	name := rendition.BlobName(location, format)
+	_, err = globalBlobStore.Put(name, buf)
+	return name, err
+}
+
+// encodeImage writes img to w in one of the formats of formatExtension.
+// quality only applies to JPEG, where 0 means the default.
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case "jpeg":
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		return imaging.Encode(w, img, imaging.PNG)
+	case "gif":
+		return imaging.Encode(w, img, imaging.GIF)
+	}
+	return imaging.ErrUnsupportedFormat
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	rebuildDateLayout = "2006-01-02"
+	// Progress is written after this many images, so an interrupted
+	// rebuild redoes at most that many
+	rebuildSaveInterval = 20
+)
+
+// RunRenditionsCommand runs `gophr renditions rebuild`, which generates the
+// renditions of images already stored again, after the list of renditions
+// changed. It returns the exit status.
+func RunRenditionsCommand(args []string) int {
+	if len(args) == 0 || args[0] != "rebuild" {
+		fmt.Fprintln(os.Stderr, "usage: gophr renditions rebuild [flags]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("renditions rebuild", flag.ContinueOnError)
+	userID := flags.String("user", "", "only images of the user with this ID")
+	since := flags.String("since", "", "only images uploaded on or after this day, as 2006-01-02")
+	until := flags.String("until", "", "only images uploaded on or before this day, as 2006-01-02")
+	missing := flags.Bool("missing", false, "only images with a configured rendition missing")
+	dryRun := flags.Bool("dry-run", false, "list what would be rebuilt without changing anything")
+	workers := flags.Int("workers", config.ProcessingWorkers, "how many images are rebuilt at once")
+	progressFile := flags.String("progress", "./data/rebuild-progress.json", "where progress is kept, to carry on after an interruption")
+	restart := flags.Bool("restart", false, "start over instead of carrying on from the progress file")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "-workers must be at least 1")
+		return 2
+	}
+
+	query := bson.M{}
+	if *userID != "" {
+		query["user_id"] = *userID
+	}
+	created := bson.M{}
+	if *since != "" {
+		day, err := time.ParseInLocation(rebuildDateLayout, *since, time.Local)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -since: %s\n", err)
+			return 2
+		}
+		created["$gte"] = day
+	}
+	if *until != "" {
+		day, err := time.ParseInLocation(rebuildDateLayout, *until, time.Local)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -until: %s\n", err)
+			return 2
+		}
+		created["$lt"] = day.AddDate(0, 0, 1)
+	}
+	if len(created) > 0 {
+		query["created_at"] = created
+	}
+
+	progress := &rebuildProgress{
+		Filters:  fmt.Sprintf("user=%s since=%s until=%s missing=%t", *userID, *since, *until, *missing),
+		filename: *progressFile,
+		dryRun:   *dryRun,
+	}
+	// A dry run covers everything, and leaves the progress alone
+	if !*dryRun && !*restart {
+		err = progress.load()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading progress: %s\n", err)
+			return 1
+		}
+	}
+	if progress.Checkpoint != "" {
+		query["_id"] = bson.M{"$gt": progress.Checkpoint}
+		fmt.Printf("Carrying on after %s, %d images done\n", progress.Checkpoint, progress.Scanned)
+	}
+	progress.finished = map[string]bool{}
+
+	rebuild := &renditionsRebuild{
+		db:      NewDBImageStore(),
+		missing: *missing,
+		dryRun:  *dryRun,
+		blobs:   map[string]*blobRebuild{},
+	}
+	defer rebuild.db.Close()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	images := make(chan Image)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for image := range images {
+				rebuilt, err := rebuild.image(&image)
+				progress.finish(image.ID, rebuilt, err)
+			}
+		}()
+	}
+
+	// Small batches, so the cursor isn't left idle long enough to time
+	// out while the workers get through them
+	iter := rebuild.db.Session.DB(dbName).C(collectionName).Find(query).Sort("_id").Batch(2 * *workers).Iter()
+	interrupted := false
+	for !interrupted {
+		image := Image{}
+		if !iter.Next(&image) {
+			break
+		}
+		progress.start(image.ID)
+		select {
+		case images <- image:
+		case <-stop:
+			interrupted = true
+		}
+	}
+	close(images)
+	wg.Wait()
+	err = iter.Close()
+
+	if saveErr := progress.save(); saveErr != nil {
+		fmt.Fprintf(os.Stderr, "Error saving progress: %s\n", saveErr)
+	}
+	progress.report()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading images: %s\n", err)
+		return 1
+	}
+	if interrupted {
+		fmt.Println("Interrupted, run the same command again to carry on")
+		return 1
+	}
+	if len(progress.Failures) > 0 {
+		return 1
+	}
+	return 0
+}
+
+type rebuildFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// rebuildProgress counts what a rebuild did, and remembers the last image
+// before which every image is done. Images are taken in order of ID, so a
+// rebuild that was interrupted carries on after that one.
+type rebuildProgress struct {
+	Filters    string           `json:"filters"`
+	Checkpoint string           `json:"checkpoint"`
+	Scanned    int              `json:"scanned"`
+	Rebuilt    int              `json:"rebuilt"`
+	Skipped    int              `json:"skipped"`
+	Failures   []rebuildFailure `json:"failures"`
+
+	filename string
+	dryRun   bool
+	mu       sync.Mutex
+	// Images handed to workers, in order, and which of them are done
+	pending  []string
+	finished map[string]bool
+}
+
+// load reads the progress of an earlier rebuild with the same filters.
+func (progress *rebuildProgress) load() error {
+	contents, err := ioutil.ReadFile(progress.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := rebuildProgress{}
+	err = json.Unmarshal(contents, &saved)
+	if err != nil {
+		return err
+	}
+	if saved.Filters != progress.Filters {
+		fmt.Printf("The last rebuild had other filters (%s), starting over\n", saved.Filters)
+		return nil
+	}
+	progress.Checkpoint = saved.Checkpoint
+	progress.Scanned = saved.Scanned
+	progress.Rebuilt = saved.Rebuilt
+	progress.Skipped = saved.Skipped
+	progress.Failures = saved.Failures
+	return nil
+}
+
+func (progress *rebuildProgress) save() error {
+	if progress.dryRun {
+		return nil
+	}
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	return progress.write()
+}
+
+func (progress *rebuildProgress) write() error {
+	contents, err := json.MarshalIndent(progress, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(progress.filename, contents, 0600)
+}
+
+func (progress *rebuildProgress) start(id string) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	progress.pending = append(progress.pending, id)
+}
+
+// finish records how rebuilding the image with the given ID went.
+func (progress *rebuildProgress) finish(id string, rebuilt bool, err error) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.Scanned++
+	if err != nil {
+		log.Printf("Error rebuilding %s: %s", id, err)
+		progress.Failures = append(progress.Failures, rebuildFailure{id, err.Error()})
+	} else if rebuilt {
+		if progress.dryRun {
+			fmt.Println(id)
+		}
+		progress.Rebuilt++
+	} else {
+		progress.Skipped++
+	}
+
+	progress.finished[id] = true
+	for len(progress.pending) > 0 && progress.finished[progress.pending[0]] {
+		progress.Checkpoint = progress.pending[0]
+		delete(progress.finished, progress.pending[0])
+		progress.pending = progress.pending[1:]
+	}
+
+	if progress.Scanned%rebuildSaveInterval == 0 && !progress.dryRun {
+		log.Printf("%d images done, %d rebuilt, %d failed", progress.Scanned, progress.Rebuilt, len(progress.Failures))
+		err = progress.write()
+		if err != nil {
+			log.Printf("Error saving progress: %s", err)
+		}
+	}
+}
+
+func (progress *rebuildProgress) report() {
+	rebuilt := "rebuilt"
+	if progress.dryRun {
+		rebuilt = "to rebuild"
+	}
+	fmt.Printf("%d images: %d %s, %d skipped, %d failed\n",
+		progress.Scanned, progress.Rebuilt, rebuilt, progress.Skipped, len(progress.Failures))
+	for _, failure := range progress.Failures {
+		fmt.Printf("  %s: %s\n", failure.ID, failure.Error)
+	}
+}
+
+// renditionsRebuild generates renditions again. Renditions shared by the
+// images of a blob are generated once, by whichever worker gets there first.
+type renditionsRebuild struct {
+	db      *DBImageStore
+	missing bool
+	dryRun  bool
+	mu      sync.Mutex
+	blobs   map[string]*blobRebuild
+}
+
+type blobRebuild struct {
+	done    chan struct{}
+	rebuilt bool
+	err     error
+}
+
+// image rebuilds the renditions of image, and reports whether there was
+// anything to rebuild.
+func (rebuild *renditionsRebuild) image(image *Image) (bool, error) {
+	// Those are still up to the job queue
+	if image.Status != "" {
+		return false, nil
+	}
+
+	var rebuilt bool
+	var err error
+	if image.Digest != "" {
+		rebuilt, err = rebuild.blob(image.Digest)
+	} else {
+		// Images from before deduplication have files of their own
+		rebuilt, err = rebuild.shared(&ImageBlob{Location: image.Location}, []Image{*image})
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Edits have renditions of their own as well
+	if len(image.Versions) > 0 && (len(image.Recipe) > 0 || image.FocalPoint != nil) {
+		edited, err := rebuild.edited(image)
+		if err != nil {
+			return false, err
+		}
+		rebuilt = rebuilt || edited
+	}
+	return rebuilt, nil
+}
+
+// blob rebuilds the renditions of the blob with the given digest, unless
+// another worker did already.
+func (rebuild *renditionsRebuild) blob(digest string) (bool, error) {
+	rebuild.mu.Lock()
+	result, ok := rebuild.blobs[digest]
+	if ok {
+		rebuild.mu.Unlock()
+		<-result.done
+		return result.rebuilt, result.err
+	}
+	result = &blobRebuild{done: make(chan struct{})}
+	rebuild.blobs[digest] = result
+	rebuild.mu.Unlock()
+
+	defer close(result.done)
+	blob, err := rebuild.db.FindBlob(digest)
+	if err != nil || blob == nil || blob.Status != "" {
+		result.err = err
+		return false, err
+	}
+	var images []Image
+	err = rebuild.db.Session.DB(dbName).C(collectionName).Find(bson.M{
+		"digest": digest,
+		"status": nil,
+	}).All(&images)
+	if err == nil {
+		result.rebuilt, err = rebuild.shared(blob, images)
+	}
+	result.err = err
+	return result.rebuilt, err
+}
+
+// shared rebuilds the renditions of blob, and points images at them. Blobs
+// without a digest are the files of a single image from before
+// deduplication, and aren't recorded anywhere else.
+func (rebuild *renditionsRebuild) shared(blob *ImageBlob, images []Image) (bool, error) {
+	if rebuild.missing && !renditionsMissing(blob.Renditions) {
+		return false, nil
+	}
+	if rebuild.dryRun {
+		return true, nil
+	}
+
+	before := &Image{Location: blob.Location, Renditions: blob.Renditions, Posters: blob.Posters}
+	if blob.Digest == "" {
+		before.Renditions, before.Posters = images[0].originalRenditions()
+	}
+	old := map[string]bool{}
+	for _, name := range before.blobNames()[1:] {
+		old[name] = true
+	}
+
+	// The new renditions replace the old ones under the same names, so
+	// only those that are new are cleaned up if that fails
+	source, err := renderBlob(blob)
+	if err != nil {
+		deleteBlobs(namesNotIn(source.renditionNames(), old))
+		return false, err
+	}
+	if blob.Digest != "" {
+		err = rebuild.db.saveBlobRenditions(blob, source)
+		if err == mgo.ErrNotFound {
+			// The last image using it went away while this ran
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	for i := range images {
+		err = rebuild.db.useRebuiltRenditions(&images[i], old, source)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	current := map[string]bool{}
+	for _, name := range source.renditionNames() {
+		current[name] = true
+	}
+	deleteBlobs(namesNotIn(before.blobNames()[1:], current))
+	return true, nil
+}
+
+// useRebuiltRenditions points every version of image shown with the
+// renditions named in old at the renditions of source instead.
+func (store *DBImageStore) useRebuiltRenditions(image *Image, old map[string]bool, source *Image) error {
+	set, unset := bson.M{}, bson.M{}
+	if usesRenditions(image.Renditions, old) {
+		setRenditions(set, unset, "", source.Renditions, source.Posters)
+		set["animated"] = source.Animated
+	}
+	for i := range image.Versions {
+		if usesRenditions(image.Versions[i].Renditions, old) {
+			setRenditions(set, unset, fmt.Sprintf("versions.%d.", i), source.Renditions, source.Posters)
+		}
+	}
+	return store.updateRenditions(image.ID, set, unset)
+}
+
+// edited rebuilds the renditions of the version of an edited image shown.
+// Earlier versions keep theirs.
+func (rebuild *renditionsRebuild) edited(image *Image) (bool, error) {
+	if rebuild.missing && !renditionsMissing(image.Renditions) {
+		return false, nil
+	}
+	if rebuild.dryRun {
+		return true, nil
+	}
+
+	// Reverting shares the files of a version with a later one, so only
+	// files no other version uses are cleaned up
+	number := image.CurrentVersion()
+	others := otherVersionNames(image, number)
+	kept := map[string]bool{}
+	for name := range others {
+		kept[name] = true
+	}
+	for _, name := range image.renditionNames() {
+		kept[name] = true
+	}
+
+	edited := *image
+	err := edited.generateRenditions(fmt.Sprintf("%s/v%d/%s", image.ID, number, image.Location))
+	if err != nil {
+		deleteBlobs(namesNotIn(edited.renditionNames(), kept))
+		return false, err
+	}
+
+	set, unset := bson.M{}, bson.M{}
+	setRenditions(set, unset, "", edited.Renditions, edited.Posters)
+	setRenditions(set, unset, fmt.Sprintf("versions.%d.", len(image.Versions)-1), edited.Renditions, edited.Posters)
+	set["animated"] = edited.Animated
+	err = rebuild.db.updateRenditions(image.ID, set, unset)
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range edited.renditionNames() {
+		others[name] = true
+	}
+	deleteBlobs(namesNotIn(image.renditionNames(), others))
+	return true, nil
+}
+
+// otherVersionNames lists the files of every version of image but the one
+// with the given number.
+func otherVersionNames(image *Image, number int) map[string]bool {
+	names := map[string]bool{}
+	for i := range image.Versions {
+		if image.Versions[i].Number == number {
+			continue
+		}
+		for _, name := range versionFiles(&image.Versions[i]) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func (store *DBImageStore) updateRenditions(id string, set, unset bson.M) error {
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	err := store.Session.DB(dbName).C(collectionName).UpdateId(id, update)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// setRenditions adds the fields of renditions and posters below prefix to
+// an update.
+func setRenditions(set, unset bson.M, prefix string, renditions, posters map[string]string) {
+	set[prefix+"renditions"] = renditions
+	if posters == nil {
+		unset[prefix+"posters"] = ""
+	} else {
+		set[prefix+"posters"] = posters
+	}
+}
+
+// usesRenditions reports whether renditions are those named in old. Images
+// from before renditions were configurable have none recorded.
+func usesRenditions(renditions map[string]string, old map[string]bool) bool {
+	if renditions == nil {
+		return true
+	}
+	for _, name := range renditions {
+		if old[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// renditionsMissing reports whether a configured rendition isn't among
+// renditions, or isn't in the blob store.
+func renditionsMissing(recorded map[string]string) bool {
+	if recorded == nil {
+		return true
+	}
+	for _, rendition := range renditions {
+		name, ok := recorded[rendition.Name]
+		if !ok {
+			return true
+		}
+		if _, err := globalBlobStore.Stat(name); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func namesNotIn(names []string, set map[string]bool) []string {
+	result := []string{}
+	for _, name := range names {
+		if !set[name] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signing of S3 requests with AWS Signature Version 4, see
+// http://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3DateFormat      = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+type S3Signer struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+}
+
+// Sign adds an Authorization header to r. payloadHash is the hex encoded
+// SHA-256 of the body.
+func (signer *S3Signer) Sign(r *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	r.Header.Set("X-Amz-Date", now.Format(s3DateFormat))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers, signedHeaders := s3CanonicalHeaders(r)
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3CanonicalURI(r.URL),
+		s3CanonicalQuery(r.URL.Query()),
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := signer.scope(now)
+	signature := signer.signature(now, scope, canonicalRequest)
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, signer.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+// Presign returns a copy of u that grants a GET of the object it points to
+// for the given time, without any further credentials.
+func (signer *S3Signer) Presign(u *url.URL, expires time.Duration, now time.Time) *url.URL {
+	now = now.UTC()
+	scope := signer.scope(now)
+
+	presigned := *u
+	query := presigned.Query()
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", signer.AccessKey+"/"+scope)
+	query.Set("X-Amz-Date", now.Format(s3DateFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		s3CanonicalURI(&presigned),
+		s3CanonicalQuery(query),
+		"host:" + presigned.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+
+	query.Set("X-Amz-Signature", signer.signature(now, scope, canonicalRequest))
+	presigned.RawQuery = s3CanonicalQuery(query)
+	return &presigned
+}
+
+func (signer *S3Signer) scope(now time.Time) string {
+	return strings.Join([]string{now.Format("20060102"), signer.Region, "s3", "aws4_request"}, "/")
+}
+
+func (signer *S3Signer) signature(now time.Time, scope, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3DateFormat),
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+signer.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, signer.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// s3CanonicalHeaders returns the headers that are signed, one "name:value"
+// per line, and the list of their names. These are the host, anything S3
+// specific and the few standard headers S3 cares about.
+func s3CanonicalHeaders(r *http.Request) (string, string) {
+	values := map[string]string{
+		"host": r.URL.Host,
+	}
+	for name, value := range r.Header {
+		name = strings.ToLower(name)
+		switch {
+		case strings.HasPrefix(name, "x-amz-"), name == "content-type", name == "content-md5", name == "range":
+			values[name] = strings.TrimSpace(strings.Join(value, ","))
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := ""
+	for _, name := range names {
+		headers += name + ":" + values[name] + "\n"
+	}
+	return headers, strings.Join(names, ";")
+}
+
+func s3CanonicalURI(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return s3Escape(u.Path, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, which
+// is stricter than url.QueryEscape and what the signature is computed over.
+func s3Escape(s string, keepSlash bool) string {
+	escaped := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			escaped = append(escaped, c)
+		default:
+			escaped = append(escaped, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(escaped)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
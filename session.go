@@ -13,9 +13,9 @@ const (
 )
 
 type Session struct {
-	ID     string
-	UserID string
-	Expiry time.Time
+	ID     string    `bson:"_id"`
+	UserID string    `bson:"user_id"`
+	Expiry time.Time `bson:"expiry"`
 }
 
 func (session *Session) Expired() bool {
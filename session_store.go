@@ -3,14 +3,22 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
 )
 
 var globalSessionStore SessionStore
 
 func InitSessionStore() {
-	sessionStore, err := NewFileSessionStore("./data/sessions.json")
+	var sessionStore SessionStore
+	var err error
+
+	switch config.SessionStore {
+	case "file":
+		sessionStore, err = NewFileSessionStore(config.SessionFile)
+	case "mongo":
+		sessionStore, err = NewDBSessionStore(mongoSession)
+	default:
+		err = fmt.Errorf("unknown session store %q", config.SessionStore)
+	}
 	if err != nil {
 		panic(fmt.Errorf("Error creating session store: %s", err))
 	}
@@ -24,25 +32,22 @@ type SessionStore interface {
 }
 
 type FileSessionStore struct {
-	filename string
-	Sessions map[string]Session
+	*FileStore `json:"-"`
+	Sessions   map[string]Session
 }
 
-func (store FileSessionStore) Save(session Session) error {
-	store.Sessions[session.ID] = session
+func (store *FileSessionStore) Save(session Session) error {
+	store.Lock()
+	defer store.Unlock()
 
-	contents, err := json.MarshalIndent(store, "", "   ")
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(store.filename, contents, 0660)
-	if err != nil {
-		return err
-	}
-	return nil
+	store.Sessions[session.ID] = session
+	return store.Record(journalSave, session.ID, session)
 }
 
-func (store FileSessionStore) Find(id string) (*Session, error) {
+func (store *FileSessionStore) Find(id string) (*Session, error) {
+	store.RLock()
+	defer store.RUnlock()
+
 	session, ok := store.Sessions[id]
 	if ok {
 		return &session, nil
@@ -50,31 +55,46 @@ func (store FileSessionStore) Find(id string) (*Session, error) {
 	return nil, nil
 }
 
-func (store FileSessionStore) Delete(sesion *Session) error {
-	delete(store.Sessions, sesion.ID)
-	contents, err := json.MarshalIndent(store, "", "   ")
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(store.filename, contents, 0660)
+func (store *FileSessionStore) Delete(session *Session) error {
+	store.Lock()
+	defer store.Unlock()
+
+	delete(store.Sessions, session.ID)
+	return store.Record(journalDelete, session.ID, nil)
 }
 
 func NewFileSessionStore(name string) (*FileSessionStore, error) {
 	store := &FileSessionStore{
 		Sessions: map[string]Session{},
-		filename: name,
 	}
 
-	contents, err := ioutil.ReadFile(name)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return store, nil
-		}
-		return nil, nil
+	var apply JournalFunc
+	if config.FileStoreMode == "journal" {
+		apply = store.apply
 	}
-	err = json.Unmarshal(contents, store)
+
+	fileStore, err := NewFileStore(name, store, apply)
 	if err != nil {
 		return nil, err
 	}
+	store.FileStore = fileStore
 	return store, nil
 }
+
+// apply replays a journal record written by Save or Delete.
+func (store *FileSessionStore) apply(record JournalRecord) error {
+	switch record.Op {
+	case journalSave:
+		session := Session{}
+		err := json.Unmarshal(record.Value, &session)
+		if err != nil {
+			return err
+		}
+		store.Sessions[record.Key] = session
+	case journalDelete:
+		delete(store.Sessions, record.Key)
+	default:
+		return fmt.Errorf("unknown journal operation %q", record.Op)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+var errInvalidTIFF = errors.New("invalid TIFF structure")
+
+// TIFF field types, and how many bytes a value of each takes
+const (
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffUndefined = 7
+	tiffSLong     = 9
+	tiffSRational = 10
+	tiffIFDType   = 13 // a LONG offset of a sub-IFD
+)
+
+var tiffTypeSize = map[uint16]uint64{
+	tiffByte:      1,
+	tiffASCII:     1,
+	tiffShort:     2,
+	tiffLong:      4,
+	tiffRational:  8,
+	tiffUndefined: 1,
+	tiffSLong:     4,
+	tiffSRational: 8,
+	tiffIFDType:   4,
+}
+
+// The most entries an IFD may have, and the most IFDs followed, so a crafted
+// file can't keep the parser busy
+const (
+	tiffMaxEntries = 1000
+	tiffMaxIFDs    = 1000
+)
+
+// tiffData reads the image file directories of a TIFF structure, which is
+// what both TIFF files and the EXIF block of a JPEG consist of.
+type tiffData struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is a field of an IFD with its values still encoded.
+type tiffEntry struct {
+	Type  uint16
+	Count uint32
+	Value []byte
+}
+
+// tiffIFD maps tags to the fields of one image file directory.
+type tiffIFD map[uint16]tiffEntry
+
+// newTIFFData checks the header of data and returns the offset of the first
+// IFD.
+func newTIFFData(data []byte) (*tiffData, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, errInvalidTIFF
+	}
+	tiff := &tiffData{data: data}
+	switch string(data[:2]) {
+	case "II":
+		tiff.order = binary.LittleEndian
+	case "MM":
+		tiff.order = binary.BigEndian
+	default:
+		return nil, 0, errInvalidTIFF
+	}
+	if tiff.order.Uint16(data[2:4]) != 42 {
+		return nil, 0, errInvalidTIFF
+	}
+	return tiff, tiff.order.Uint32(data[4:8]), nil
+}
+
+// bytes returns length bytes from offset, or nil if they're out of range.
+func (tiff *tiffData) bytes(offset uint32, length uint64) []byte {
+	end := uint64(offset) + length
+	if end > uint64(len(tiff.data)) {
+		return nil
+	}
+	return tiff.data[offset:end]
+}
+
+// readIFD reads the IFD at offset, and returns it with the offset of the
+// next IFD, which is 0 after the last one.
+func (tiff *tiffData) readIFD(offset uint32) (tiffIFD, uint32, error) {
+	header := tiff.bytes(offset, 2)
+	if header == nil {
+		return nil, 0, errInvalidTIFF
+	}
+	count := tiff.order.Uint16(header)
+	if count > tiffMaxEntries {
+		return nil, 0, errInvalidTIFF
+	}
+	entries := tiff.bytes(offset+2, uint64(count)*12+4)
+	if entries == nil {
+		return nil, 0, errInvalidTIFF
+	}
+
+	ifd := tiffIFD{}
+	for i := 0; i < int(count); i++ {
+		entry := entries[i*12 : i*12+12]
+		tag := tiff.order.Uint16(entry[0:2])
+		field := tiffEntry{
+			Type:  tiff.order.Uint16(entry[2:4]),
+			Count: tiff.order.Uint32(entry[4:8]),
+		}
+		size, ok := tiffTypeSize[field.Type]
+		if !ok {
+			// Types we never read, skip them
+			continue
+		}
+		length := size * uint64(field.Count)
+		if length <= 4 {
+			field.Value = entry[8 : 8+length]
+		} else {
+			field.Value = tiff.bytes(tiff.order.Uint32(entry[8:12]), length)
+			if field.Value == nil {
+				continue
+			}
+		}
+		ifd[tag] = field
+	}
+	return ifd, tiff.order.Uint32(entries[count*12:]), nil
+}
+
+// countIFDs follows the chain of IFDs from offset. Every page of a TIFF file
+// has one of its own.
+func (tiff *tiffData) countIFDs(offset uint32) (int, error) {
+	seen := map[uint32]bool{}
+	for count := 0; count < tiffMaxIFDs; count++ {
+		if offset == 0 {
+			return count, nil
+		}
+		if seen[offset] {
+			return 0, errInvalidTIFF
+		}
+		seen[offset] = true
+
+		var err error
+		_, offset, err = tiff.readIFD(offset)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, errInvalidTIFF
+}
+
+// ascii returns the text of a field, without the terminating NUL and padding.
+func (tiff *tiffData) ascii(ifd tiffIFD, tag uint16) string {
+	field, ok := ifd[tag]
+	if !ok || (field.Type != tiffASCII && field.Type != tiffUndefined) {
+		return ""
+	}
+	value := string(field.Value)
+	if i := strings.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// uint returns the i-th value of a BYTE, SHORT, LONG or IFD field.
+func (tiff *tiffData) uint(ifd tiffIFD, tag uint16, i int) (uint32, bool) {
+	field, ok := ifd[tag]
+	if !ok || i >= int(field.Count) {
+		return 0, false
+	}
+	switch {
+	case field.Type == tiffByte && len(field.Value) >= i+1:
+		return uint32(field.Value[i]), true
+	case field.Type == tiffShort && len(field.Value) >= (i+1)*2:
+		return uint32(tiff.order.Uint16(field.Value[i*2:])), true
+	case (field.Type == tiffLong || field.Type == tiffIFDType) && len(field.Value) >= (i+1)*4:
+		return tiff.order.Uint32(field.Value[i*4:]), true
+	}
+	return 0, false
+}
+
+// rational returns the numerator and denominator of the i-th value of a
+// RATIONAL or SRATIONAL field.
+func (tiff *tiffData) rational(ifd tiffIFD, tag uint16, i int) (int64, int64, bool) {
+	field, ok := ifd[tag]
+	if !ok || i >= int(field.Count) {
+		return 0, 0, false
+	}
+	if field.Type != tiffRational && field.Type != tiffSRational {
+		return 0, 0, false
+	}
+	// The count comes from the file, and may claim more than the value has
+	if len(field.Value) < (i+1)*8 {
+		return 0, 0, false
+	}
+	num := tiff.order.Uint32(field.Value[i*8:])
+	den := tiff.order.Uint32(field.Value[i*8+4:])
+	if field.Type == tiffSRational {
+		return int64(int32(num)), int64(int32(den)), den != 0
+	}
+	return int64(num), int64(den), den != 0
+}
+
+// float returns the i-th value of a RATIONAL or SRATIONAL field as a float.
+func (tiff *tiffData) float(ifd tiffIFD, tag uint16, i int) (float64, bool) {
+	num, den, ok := tiff.rational(ifd, tag, i)
+	if !ok {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+// clearSubIFD empties the IFD the given field of ifd points to, such as the
+// Exif or GPS directory. Both the directory and the values it points to are
+// zeroed, in place.
+func (tiff *tiffData) clearSubIFD(ifd tiffIFD, tag uint16) error {
+	offset, ok := tiff.uint(ifd, tag, 0)
+	if !ok {
+		return nil
+	}
+	sub, _, err := tiff.readIFD(offset)
+	if err != nil {
+		return err
+	}
+
+	// The values slice into the data, so this clears them in place
+	for _, field := range sub {
+		zeroBytes(field.Value)
+	}
+	count := uint64(tiff.order.Uint16(tiff.data[offset:]))
+	zeroBytes(tiff.bytes(offset, 2+count*12+4))
+	return nil
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+var errInvalidTransform = errors.New("invalid transformation")
+
+// Fit modes of a transformation and the rendition modes they map to
+var transformFits = map[string]string{
+	"contain": renditionFit,
+	"cover":   renditionFill,
+	"crop":    renditionCrop,
+}
+
+// Transform is an on-demand transformation of an original, written in URLs
+// as a comma separated list of parameters followed by the output format:
+//
+//	w_640,h_480,fit_cover,q_80.jpg
+//
+// Only these parameters are accepted, and w or h must be given:
+//
+//	w_N, h_N            the size, of config.TransformSizes up to
+//	                    config.TransformMaxSize
+//	fit_contain         scale to fit inside the size, the default
+//	fit_cover           scale and crop to exactly the size
+//	fit_crop            cut the size out of the middle without scaling
+//	r_90, r_180, r_270  rotate counter-clockwise
+//	flip_h, flip_v      flip horizontally or vertically
+//	q_N                 JPEG quality, of config.TransformQualities
+type Transform struct {
+	Width   int
+	Height  int
+	Fit     string
+	Rotate  int
+	Flip    string
+	Quality int
+	Format  string
+}
+
+// ParseTransform reads a transformation from its URL form. Anything outside
+// the allowlist above is rejected with errInvalidTransform.
+func ParseTransform(spec string) (*Transform, error) {
+	ext := filepath.Ext(spec)
+	format, ok := extensionFormat[ext]
+	if !ok || ext == ".jpeg" {
+		return nil, errInvalidTransform
+	}
+
+	transform := &Transform{Format: format}
+	seen := map[string]bool{}
+	for _, param := range strings.Split(strings.TrimSuffix(spec, ext), ",") {
+		parts := strings.SplitN(param, "_", 2)
+		if len(parts) != 2 || seen[parts[0]] {
+			return nil, errInvalidTransform
+		}
+		key, value := parts[0], parts[1]
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "w":
+			transform.Width, err = transformInt(value, 1, config.TransformMaxSize, config.TransformSizes)
+		case "h":
+			transform.Height, err = transformInt(value, 1, config.TransformMaxSize, config.TransformSizes)
+		case "q":
+			transform.Quality, err = transformInt(value, 1, 100, config.TransformQualities)
+		case "fit":
+			if _, ok := transformFits[value]; !ok {
+				err = errInvalidTransform
+			}
+			transform.Fit = value
+		case "r":
+			transform.Rotate, err = transformInt(value, 90, 270, []int{90, 180, 270})
+		case "flip":
+			if value != "h" && value != "v" {
+				err = errInvalidTransform
+			}
+			transform.Flip = value
+		default:
+			err = errInvalidTransform
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if transform.Fit == "" {
+		transform.Fit = "contain"
+	}
+	// Without a size the result would be as large as the original
+	if transform.Width == 0 && transform.Height == 0 {
+		return nil, errInvalidTransform
+	}
+	if transform.Fit != "contain" && (transform.Width == 0 || transform.Height == 0) {
+		return nil, errInvalidTransform
+	}
+	if transform.Quality != 0 && transform.Format != "jpeg" {
+		return nil, errInvalidTransform
+	}
+	return transform, nil
+}
+
+// transformInt parses one of allowed between min and max. Leading zeros and
+// signs are refused, so every transformation has just one way of being
+// written.
+func transformInt(value string, min, max int, allowed []int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max || strconv.Itoa(n) != value {
+		return 0, errInvalidTransform
+	}
+	for _, a := range allowed {
+		if n == a {
+			return n, nil
+		}
+	}
+	return 0, errInvalidTransform
+}
+
+// String writes the transformation with its parameters in a fixed order. It
+// is used as the cache key, so the same transformation asked for in a
+// different order is only done once.
+func (transform *Transform) String() string {
+	params := []string{}
+	if transform.Width != 0 {
+		params = append(params, "w_"+strconv.Itoa(transform.Width))
+	}
+	if transform.Height != 0 {
+		params = append(params, "h_"+strconv.Itoa(transform.Height))
+	}
+	params = append(params, "fit_"+transform.Fit)
+	if transform.Rotate != 0 {
+		params = append(params, "r_"+strconv.Itoa(transform.Rotate))
+	}
+	if transform.Flip != "" {
+		params = append(params, "flip_"+transform.Flip)
+	}
+	if transform.Quality != 0 {
+		params = append(params, "q_"+strconv.Itoa(transform.Quality))
+	}
+	return strings.Join(params, ",") + formatExtension[transform.Format]
+}
+
+// Apply rotates, flips and then resizes srcImage. Crops keep focus, a point
+// of srcImage, in view.
+func (transform *Transform) Apply(srcImage image.Image, focus FocalPoint) image.Image {
+	dstImage := srcImage
+	focus = focus.rotate(transform.Rotate).flip(transform.Flip)
+	switch transform.Rotate {
+	case 90:
+		dstImage = imaging.Rotate90(dstImage)
+	case 180:
+		dstImage = imaging.Rotate180(dstImage)
+	case 270:
+		dstImage = imaging.Rotate270(dstImage)
+	}
+	switch transform.Flip {
+	case "h":
+		dstImage = imaging.FlipH(dstImage)
+	case "v":
+		dstImage = imaging.FlipV(dstImage)
+	}
+
+	if transform.Width == 0 && transform.Height == 0 {
+		return dstImage
+	}
+	rendition := &Rendition{
+		Width:  transform.Width,
+		Height: transform.Height,
+		Mode:   transformFits[transform.Fit],
+		Filter: "lanczos",
+	}
+	return rendition.Resize(dstImage, focus)
+}
+
+// transformSlots limits how many transformations run at once, so a burst of
+// requests for uncached sizes can't take every core.
+var transformSlots chan struct{}
+
+// Render decodes the original of image, transforms it and returns the
+// encoded result.
+func (transform *Transform) Render(image *Image) ([]byte, error) {
+	transformSlots <- struct{}{}
+	defer func() { <-transformSlots }()
+
+	srcImage, err := image.decodeOriginal()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = encodeImage(buf, transform.Apply(srcImage, image.focus(srcImage)), transform.Format, transform.Quality)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
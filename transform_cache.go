@@ -0,0 +1,212 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var globalTransformCache *TransformCache
+
+// TransformCache keeps the results of on-demand transformations on disk, as
+// one file per image, version and transformation below dir/imageID/vN/. Once
+// the files add up to more than maxSize bytes the least recently used ones
+// are removed.
+//
+// Every instance has a cache of its own. As results are looked up by the
+// version of the image, which is read from the database, one made from a
+// version replaced since is never served, whichever instance replaced it.
+type TransformCache struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	lru     *list.List // of *transformCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type transformCacheEntry struct {
+	key  string
+	size int64
+}
+
+// InitTransformCache opens the cache for on-demand transformations and sets
+// how many of them may run at once.
+func InitTransformCache() {
+	transformSlots = make(chan struct{}, config.TransformWorkers)
+
+	cache, err := NewTransformCache(config.TransformCacheDir, config.TransformCacheSize)
+	if err != nil {
+		panic(fmt.Errorf("Error opening transform cache: %s", err))
+	}
+	globalTransformCache = cache
+}
+
+// NewTransformCache opens the cache in dir, picking up the files left there
+// by an earlier run in the order they were last written.
+func NewTransformCache(dir string, maxSize int64) (*TransformCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	cache := &TransformCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+
+	var files []os.FileInfo
+	keys := map[os.FileInfo]string{}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		key, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		// Leftovers of writes that never finished
+		if strings.HasPrefix(info.Name(), ".tmp") {
+			return os.Remove(path)
+		}
+		files = append(files, info)
+		keys[info] = filepath.ToSlash(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byModTime(files))
+	for _, info := range files {
+		cache.add(keys[info], info.Size())
+	}
+	cache.evict()
+	return cache, nil
+}
+
+type byModTime []os.FileInfo
+
+func (files byModTime) Len() int           { return len(files) }
+func (files byModTime) Less(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) }
+func (files byModTime) Swap(i, j int)      { files[i], files[j] = files[j], files[i] }
+
+func transformCacheKey(image *Image, transform *Transform) string {
+	return fmt.Sprintf("%s/v%d/%s", image.ID, image.CurrentVersion(), transform)
+}
+
+func (cache *TransformCache) path(key string) string {
+	return filepath.Join(cache.dir, filepath.FromSlash(key))
+}
+
+// Open returns the cached result of transform applied to the version of the
+// image shown, or nil if there is none.
+func (cache *TransformCache) Open(image *Image, transform *Transform) *os.File {
+	key := transformCacheKey(image, transform)
+
+	cache.Lock()
+	defer cache.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	file, err := os.Open(cache.path(key))
+	if err != nil {
+		// Someone removed it behind our back
+		cache.remove(element)
+		return nil
+	}
+	cache.lru.MoveToFront(element)
+	return file
+}
+
+// Put stores the result of transform applied to image, as it was when it
+// was read. A result put after the image was edited is kept under the
+// version it was made from, which is no longer looked up.
+func (cache *TransformCache) Put(image *Image, transform *Transform, contents []byte) error {
+	key := transformCacheKey(image, transform)
+	dir := filepath.Dir(cache.path(key))
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cache.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.size -= element.Value.(*transformCacheEntry).size
+		cache.lru.Remove(element)
+		delete(cache.entries, key)
+	}
+	cache.add(key, int64(len(contents)))
+	cache.evict()
+	return nil
+}
+
+// Invalidate forgets every transformation of the image, to free the space
+// they take once the image is deleted or edited.
+func (cache *TransformCache) Invalidate(imageID string) error {
+	prefix := imageID + "/"
+
+	cache.Lock()
+	defer cache.Unlock()
+	for key, element := range cache.entries {
+		if strings.HasPrefix(key, prefix) {
+			cache.size -= element.Value.(*transformCacheEntry).size
+			cache.lru.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+	return os.RemoveAll(filepath.Join(cache.dir, imageID))
+}
+
+func (cache *TransformCache) add(key string, size int64) {
+	cache.entries[key] = cache.lru.PushFront(&transformCacheEntry{key, size})
+	cache.size += size
+}
+
+func (cache *TransformCache) remove(element *list.Element) {
+	entry := element.Value.(*transformCacheEntry)
+	cache.lru.Remove(element)
+	delete(cache.entries, entry.key)
+	cache.size -= entry.size
+
+	err := os.Remove(cache.path(entry.key))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing %s from transform cache: %s", entry.key, err)
+	}
+	// Drops the directories of the version and the image once they're empty
+	dir := filepath.Dir(cache.path(entry.key))
+	os.Remove(dir)
+	os.Remove(filepath.Dir(dir))
+}
+
+// evict removes the least recently used files until the cache fits.
+func (cache *TransformCache) evict() {
+	for cache.size > cache.maxSize && cache.lru.Len() > 0 {
+		cache.remove(cache.lru.Back())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// setTransformConfig sets the sizes and qualities the tests below expect,
+// whatever the environment says, and returns a function restoring them.
+func setTransformConfig() func() {
+	sizes, qualities, maxSize := config.TransformSizes, config.TransformQualities, config.TransformMaxSize
+	config.TransformSizes = []int{200, 480, 640, 4096}
+	config.TransformQualities = []int{80}
+	config.TransformMaxSize = 2048
+	return func() {
+		config.TransformSizes, config.TransformQualities, config.TransformMaxSize = sizes, qualities, maxSize
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	defer setTransformConfig()()
+
+	tests := []struct {
+		spec string
+		want *Transform // nil if it's refused
+	}{
+		{"w_640.jpg", &Transform{Width: 640, Fit: "contain", Format: "jpeg"}},
+		{"h_480.png", &Transform{Height: 480, Fit: "contain", Format: "png"}},
+		{"w_640,h_480,fit_cover,q_80.jpg", &Transform{Width: 640, Height: 480, Fit: "cover", Quality: 80, Format: "jpeg"}},
+		{"q_80,fit_crop,h_480,w_640.jpg", &Transform{Width: 640, Height: 480, Fit: "crop", Quality: 80, Format: "jpeg"}},
+		{"w_200,r_90,flip_h.gif", &Transform{Width: 200, Fit: "contain", Rotate: 90, Flip: "h", Format: "gif"}},
+
+		// Neither a width nor a height
+		{"r_90.png", nil},
+		{"fit_contain.png", nil},
+		{"flip_h.jpg", nil},
+		{"q_80.jpg", nil},
+		// Crops need both
+		{"w_640,fit_cover.jpg", nil},
+		{"h_480,fit_crop.jpg", nil},
+
+		// Only the listed sizes and qualities, up to the largest size
+		{"w_320.jpg", nil},
+		{"w_4096.jpg", nil},
+		{"w_640,q_81.jpg", nil},
+		// One way of writing each
+		{"w_0640.jpg", nil},
+		{"w_+640.jpg", nil},
+		{"w_640.jpeg", nil},
+		{"w_640,w_640.jpg", nil},
+		// Quality is for JPEGs only
+		{"w_640,q_80.png", nil},
+
+		{"w_640", nil},
+		{"w_640.bmp", nil},
+		{"w_640,r_45.jpg", nil},
+		{"w_640,flip_d.jpg", nil},
+		{"w_640,fit_stretch.jpg", nil},
+		{"w_640,blur_5.jpg", nil},
+		{"w640.jpg", nil},
+		{".jpg", nil},
+	}
+	for _, test := range tests {
+		transform, err := ParseTransform(test.spec)
+		if test.want == nil {
+			if err != errInvalidTransform {
+				t.Errorf("%s: got %+v, %v, want errInvalidTransform", test.spec, transform, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(transform, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.spec, transform, test.want)
+		}
+	}
+}
+
+func TestTransformString(t *testing.T) {
+	defer setTransformConfig()()
+
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"w_640.jpg", "w_640,fit_contain.jpg"},
+		{"q_80,fit_cover,h_480,w_640.jpg", "w_640,h_480,fit_cover,q_80.jpg"},
+		{"flip_v,r_270,h_200.png", "h_200,fit_contain,r_270,flip_v.png"},
+	}
+	for _, test := range tests {
+		transform, err := ParseTransform(test.spec)
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		got := transform.String()
+		if got != test.want {
+			t.Errorf("%s: String() = %q, want %q", test.spec, got, test.want)
+		}
+		// The cache key reads back as the same transformation
+		again, err := ParseTransform(got)
+		if err != nil || !reflect.DeepEqual(again, transform) {
+			t.Errorf("%s: parsing %q gave %+v, %v", test.spec, got, again, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const trashPurgeInterval = time.Hour
+
+// StartTrashPurger deletes images that have been in the trash for longer than
+// config.TrashRetention, checking once an hour.
+func StartTrashPurger() {
+	go func() {
+		for {
+			err := PurgeTrash(time.Now().Add(-config.TrashRetention))
+			if err != nil {
+				log.Printf("Error purging trash: %s", err)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
+
+// PurgeTrash deletes every image that was moved to the trash before the given
+// time, together with files no other image uses.
+func PurgeTrash(before time.Time) error {
+	db := NewDBImageStore()
+	defer db.Close()
+
+	images, err := db.FindTrashedBefore(before)
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		err = images[i].Delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
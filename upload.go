@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	uploadsCollectionName = "uploads"
+	uploadIDLength        = 16
+	uploadChunkIDLength   = 8
+	uploadPurgeInterval   = time.Hour
+	// How long making a complete upload into an image may take before
+	// another request may try again
+	uploadFinishTimeout = 10 * time.Minute
+	// Chunks are stored below this in the blob store, and never served
+	uploadBlobPrefix = "uploads/"
+	// Every chunk but the last must be at least this large, which bounds
+	// how many an upload can have
+	uploadMinChunkSize = 1 << 20
+)
+
+var (
+	errInvalidUploadMetadata = errors.New("invalid Upload-Metadata")
+	errUploadChanged         = errors.New("the upload was changed by another request")
+	errUploadChunkTooSmall   = fmt.Errorf("chunks must be at least %d bytes, except the last", uploadMinChunkSize)
+)
+
+// Upload is a file being uploaded in chunks with the tus protocol, so an
+// upload that was cut off can carry on where it stopped. Each chunk is kept
+// in the blob store, so the next one may be sent to any instance. Once
+// they're all there the upload is made into an image like any other, and
+// kept until it expires so the client can still ask how it went.
+type Upload struct {
+	ID        string            `bson:"_id"`
+	UserID    string            `bson:"user_id"`
+	Length    int64             `bson:"length"`
+	Offset    int64             `bson:"offset"`
+	Chunks    []string          `bson:"chunks,omitempty"` // blob names, in order
+	Metadata  map[string]string `bson:"metadata,omitempty"`
+	CreatedAt time.Time         `bson:"created_at"`
+	// Uploads nothing was added to for config.UploadExpiry are removed
+	ExpiresAt time.Time `bson:"expires_at"`
+	// Set while a request makes the complete upload into an image
+	FinishingUntil time.Time `bson:"finishing_until,omitempty"`
+	// Once complete, the image made of it or why there is none
+	ImageID string `bson:"image_id,omitempty"`
+	Error   string `bson:"error,omitempty"`
+}
+
+// InitUploads makes sure the uploads collection has the indexes expired
+// uploads and those of a user are found with.
+func InitUploads() {
+	db := NewDBImageStore()
+	defer db.Close()
+	c := db.Session.DB(dbName).C(uploadsCollectionName)
+	for _, key := range []string{"expires_at", "user_id"} {
+		err := c.EnsureIndexKey(key)
+		if err != nil {
+			panic(fmt.Errorf("Error creating upload indexes: %s", err))
+		}
+	}
+}
+
+func NewUpload(user *User, length int64, metadata map[string]string) *Upload {
+	now := time.Now()
+	return &Upload{
+		ID:        GenerateID("upl", uploadIDLength),
+		UserID:    user.ID,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.UploadExpiry),
+	}
+}
+
+func (upload *Upload) Route() string {
+	return "/uploads/" + upload.ID
+}
+
+// chunkName returns a new blob name for a chunk of the upload. Every request
+// stores its chunk under a name of its own, so one that loses the race to
+// add it can remove it again without touching anyone else's.
+func (upload *Upload) chunkName() string {
+	return uploadBlobPrefix + upload.ID + "/" + GenerateID("chk", uploadChunkIDLength)
+}
+
+// IsUploadBlob reports whether name is a chunk of a resumable upload.
+func IsUploadBlob(name string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(name, "/"), uploadBlobPrefix)
+}
+
+// Complete reports whether every byte of the upload was received.
+func (upload *Upload) Complete() bool {
+	return upload.Offset == upload.Length
+}
+
+// Finished reports whether the complete upload was made into an image, or
+// turned out not to be one.
+func (upload *Upload) Finished() bool {
+	return upload.ImageID != "" || upload.Error != ""
+}
+
+func (upload *Upload) Expired() bool {
+	return time.Now().After(upload.ExpiresAt)
+}
+
+// Create records a new upload.
+func (upload *Upload) Create() error {
+	db := NewDBImageStore()
+	defer db.Close()
+	return db.Session.DB(dbName).C(uploadsCollectionName).Insert(upload)
+}
+
+// Append stores what can be read from r, up to the length of the upload, as
+// its next chunk. What was received is kept even if reading r fails part
+// way, as happens when the connection drops, so the client can carry on from
+// there. A chunk smaller than uploadMinChunkSize that doesn't end the upload
+// is dropped with errUploadChunkTooSmall. The offset only moves on if no
+// other request moved it first, which otherwise gives errUploadChanged and
+// drops the chunk.
+func (upload *Upload) Append(r io.Reader) error {
+	body := &cutOffReader{r: io.LimitReader(r, upload.Length-upload.Offset)}
+	name := upload.chunkName()
+	n, err := globalBlobStore.Put(name, body)
+	if err != nil {
+		globalBlobStore.Delete(name)
+		return err
+	}
+	if body.err != nil {
+		log.Printf("Upload %s cut off at %d bytes: %s", upload.ID, upload.Offset+n, body.err)
+	}
+	if n == 0 {
+		return globalBlobStore.Delete(name)
+	}
+	if n < uploadMinChunkSize && upload.Offset+n < upload.Length {
+		globalBlobStore.Delete(name)
+		return errUploadChunkTooSmall
+	}
+
+	expiresAt := time.Now().Add(config.UploadExpiry)
+	db := NewDBImageStore()
+	defer db.Close()
+	err = db.Session.DB(dbName).C(uploadsCollectionName).Update(bson.M{
+		"_id":    upload.ID,
+		"offset": upload.Offset,
+	}, bson.M{
+		"$set":  bson.M{"offset": upload.Offset + n, "expires_at": expiresAt},
+		"$push": bson.M{"chunks": name},
+	})
+	if err != nil {
+		globalBlobStore.Delete(name)
+		if err == mgo.ErrNotFound {
+			return errUploadChanged
+		}
+		return err
+	}
+	upload.Offset += n
+	upload.ExpiresAt = expiresAt
+	upload.Chunks = append(upload.Chunks, name)
+	return nil
+}
+
+// cutOffReader ends where reading fails, and keeps the error.
+type cutOffReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *cutOffReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Finish makes the complete upload into an image of user, through the same
+// steps as a form upload. Whether that worked is recorded, and the chunks of
+// the upload are removed. An error that isn't a ValidationError leaves the
+// upload as it is, to be tried again. It returns errUploadChanged if another
+// request is already at it.
+func (upload *Upload) Finish(user *User) (*Image, error) {
+	db := NewDBImageStore()
+	defer db.Close()
+	c := db.Session.DB(dbName).C(uploadsCollectionName)
+
+	now := time.Now()
+	err := c.Update(bson.M{
+		"_id":      upload.ID,
+		"offset":   upload.Length,
+		"image_id": bson.M{"$exists": false},
+		"error":    bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"finishing_until": bson.M{"$exists": false}},
+			{"finishing_until": bson.M{"$lt": now}},
+		},
+	}, bson.M{"$set": bson.M{"finishing_until": now.Add(uploadFinishTimeout)}})
+	if err == mgo.ErrNotFound {
+		return nil, errUploadChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	image := NewImage(user)
+	image.Name = upload.Metadata["filename"]
+	if image.Name == "" {
+		image.Name = upload.Metadata["name"]
+	}
+	image.Description = upload.Metadata["description"]
+	if upload.Metadata["allowDuplicate"] == "1" {
+		image.AllowDuplicate()
+	}
+
+	err = image.CreatedFromUpload(upload)
+	if err != nil && !IsValidationError(err) {
+		c.UpdateId(upload.ID, bson.M{"$unset": bson.M{"finishing_until": ""}})
+		return nil, err
+	}
+	result := bson.M{}
+	if err != nil {
+		upload.Error = err.Error()
+		result["error"] = upload.Error
+	} else {
+		upload.ImageID = image.ID
+		result["image_id"] = upload.ImageID
+	}
+
+	updateErr := c.UpdateId(upload.ID, bson.M{
+		"$set":   result,
+		"$unset": bson.M{"chunks": "", "finishing_until": ""},
+	})
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	upload.deleteChunks()
+	upload.Chunks = nil
+	return image, err
+}
+
+// CreatedFromUpload stores the bytes of a complete resumable upload as the
+// original of the image, as CreatedFromFile does for a form upload.
+func (image *Image) CreatedFromUpload(upload *Upload) error {
+	chunks := &chunksReader{names: upload.Chunks}
+	defer chunks.Close()
+
+	err := image.storeOriginal(chunks)
+	if err != nil {
+		return err
+	}
+	return image.save()
+}
+
+// chunksReader reads the chunks of an upload one after the other, opening
+// each once the one before was read.
+type chunksReader struct {
+	names []string
+	blob  BlobReader
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.blob == nil {
+			if len(r.names) == 0 {
+				return 0, io.EOF
+			}
+			blob, _, err := globalBlobStore.Get(r.names[0])
+			if err != nil {
+				return 0, err
+			}
+			r.blob, r.names = blob, r.names[1:]
+		}
+		n, err := r.blob.Read(p)
+		if err == io.EOF {
+			r.blob.Close()
+			r.blob = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunksReader) Close() error {
+	if r.blob == nil {
+		return nil
+	}
+	return r.blob.Close()
+}
+
+// deleteChunks removes the chunks of the upload from the blob store. Those
+// that can't be are logged, and left behind.
+func (upload *Upload) deleteChunks() {
+	for _, name := range upload.Chunks {
+		err := globalBlobStore.Delete(name)
+		if err != nil {
+			log.Printf("Error deleting chunk %s of upload %s: %s", name, upload.ID, err)
+		}
+	}
+}
+
+// Delete removes the upload and what was received of it.
+func (upload *Upload) Delete() error {
+	return removeUpload(bson.M{"_id": upload.ID})
+}
+
+// removeUpload removes the upload query matches, if any, and then its
+// chunks. The upload is taken out of the collection as it is at that moment,
+// so a chunk added just before is removed with it, and one added just after
+// is refused.
+func removeUpload(query bson.M) error {
+	db := NewDBImageStore()
+	defer db.Close()
+
+	removed := &Upload{}
+	_, err := db.Session.DB(dbName).C(uploadsCollectionName).Find(query).Apply(mgo.Change{Remove: true}, removed)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	removed.deleteChunks()
+	return nil
+}
+
+// FindUpload returns the upload with the given ID, or nil if there is none.
+func (store *DBImageStore) FindUpload(id string) (*Upload, error) {
+	upload := &Upload{}
+	err := store.Session.DB(dbName).C(uploadsCollectionName).FindId(id).One(upload)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// CountOpenUploads returns how many uploads of the user are still being
+// added to or made into an image.
+func (store *DBImageStore) CountOpenUploads(user *User) (int, error) {
+	return store.Session.DB(dbName).C(uploadsCollectionName).Find(bson.M{
+		"user_id":    user.ID,
+		"image_id":   bson.M{"$exists": false},
+		"error":      bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Count()
+}
+
+// StartUploadPurger removes expired uploads, checking once an hour.
+func StartUploadPurger() {
+	go func() {
+		for {
+			err := PurgeUploads(time.Now())
+			if err != nil {
+				log.Printf("Error purging uploads: %s", err)
+			}
+			time.Sleep(uploadPurgeInterval)
+		}
+	}()
+}
+
+// PurgeUploads removes every upload that expired before the given time.
+// Uploads being made into an image are left until that's done.
+func PurgeUploads(before time.Time) error {
+	db := NewDBImageStore()
+	defer db.Close()
+
+	expired := bson.M{
+		"expires_at": bson.M{"$lt": before},
+		"$or": []bson.M{
+			{"finishing_until": bson.M{"$exists": false}},
+			{"finishing_until": bson.M{"$lt": time.Now()}},
+		},
+	}
+	var uploads []Upload
+	err := db.Session.DB(dbName).C(uploadsCollectionName).Find(expired).Select(bson.M{"_id": 1}).All(&uploads)
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		// Still expired, unless a chunk was added since
+		query := bson.M{"_id": upload.ID}
+		for key, value := range expired {
+			query[key] = value
+		}
+		err = removeUpload(query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseUploadMetadata reads an Upload-Metadata header, pairs of a key and
+// a base64 encoded value separated by commas.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errInvalidUploadMetadata
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, errInvalidUploadMetadata
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
+
+func formatUploadMetadata(metadata map[string]string) string {
+	keys := []string{}
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		if metadata[key] == "" {
+			pairs = append(pairs, key)
+			continue
+		}
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(metadata[key])))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -8,10 +8,13 @@ import (
 )
 
 type User struct {
-	ID             string
-	Email          string
-	HashedPassword string
-	UserName       string
+	ID             string `bson:"_id"`
+	Email          string `bson:"email"`
+	HashedPassword string `bson:"hashed_password"`
+	UserName       string `bson:"username"`
+	// How much metadata is left in originals, see privacy.go
+	MetadataPolicy string        `bson:"metadata_policy,omitempty"`
+	PrivacyZones   []PrivacyZone `bson:"privacy_zones,omitempty"`
 }
 
 const (
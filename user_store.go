@@ -3,16 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"strings"
 )
 
 var globalUserStore UserStore
 
-//var globalUsernameStore []string
-//var globalUserEmailStore []string
-
 type UserStore interface {
 	Find(string) (*User, error)
 	FindByEmail(string) (*User, error)
@@ -21,7 +16,21 @@ type UserStore interface {
 }
 
 func InitUserStore() {
-	store, err := NewFileUserStore("./data/users.json")
+	var store UserStore
+	var err error
+
+	switch config.UserStore {
+	case "file":
+		store, err = NewFileUserStore(config.UserFile)
+	case "mongo":
+		store, err = NewDBUserStore(mongoSession)
+		if err == nil {
+			// Bring over anyone still sitting in the file store
+			_, err = MigrateFileUsers(config.UserFile, store)
+		}
+	default:
+		err = fmt.Errorf("unknown user store %q", config.UserStore)
+	}
 	if err != nil {
 		panic(fmt.Errorf("Error creating user store: %s", err))
 	}
@@ -29,27 +38,22 @@ func InitUserStore() {
 }
 
 type FileUserStore struct {
-	filename string
-	Users    map[string]User
+	*FileStore `json:"-"`
+	Users      map[string]User
 }
 
-func (store FileUserStore) Save(user User) error {
-	store.Users[user.ID] = user
-	//globalUsernameStore = append(globalUsernameStore, user.UserName)
-	//globalUserEmailStore = append(globalUserEmailStore, user.Email)
+func (store *FileUserStore) Save(user User) error {
+	store.Lock()
+	defer store.Unlock()
 
-	contents, err := json.MarshalIndent(store, "", "   ")
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(store.filename, contents, 0660)
-	if err != nil {
-		return err
-	}
-	return nil
+	store.Users[user.ID] = user
+	return store.Record(journalSave, user.ID, user)
 }
 
-func (store FileUserStore) Find(id string) (*User, error) {
+func (store *FileUserStore) Find(id string) (*User, error) {
+	store.RLock()
+	defer store.RUnlock()
+
 	user, ok := store.Users[id]
 	if ok {
 		return &user, nil
@@ -57,62 +61,75 @@ func (store FileUserStore) Find(id string) (*User, error) {
 	return nil, nil
 }
 
-func (store FileUserStore) FindByUsername(username string) (*User, error) {
+func (store *FileUserStore) FindByUsername(username string) (*User, error) {
 	if username == "" {
 		return nil, nil
 	}
+
+	store.RLock()
+	defer store.RUnlock()
+
 	for _, user := range store.Users {
 		if strings.ToLower(username) == strings.ToLower(user.UserName) {
 			return &user, nil
 		}
 	}
-	/*for _, usernameGlobal := range globalUsernameStore {
-		if strings.ToLower(username) == strings.ToLower(usernameGlobal) {
-			return &User{}, nil
-		}
-	}*/
 	return nil, nil
 }
 
-func (store FileUserStore) FindByEmail(email string) (*User, error) {
+func (store *FileUserStore) FindByEmail(email string) (*User, error) {
 	if email == "" {
 		return nil, nil
 	}
 
+	store.RLock()
+	defer store.RUnlock()
+
 	for _, user := range store.Users {
 		if strings.ToLower(email) == strings.ToLower(user.Email) {
 			return &user, nil
 		}
 	}
-	/*for _, userEmailGlobal := range globalUserEmailStore {
-		if strings.ToLower(email) == strings.ToLower(userEmailGlobal) {
-			return &User{}, nil
-		}
-	}*/
 	return nil, nil
 }
 
 func NewFileUserStore(filename string) (*FileUserStore, error) {
+	return newFileUserStore(filename, config.FileStoreMode == "journal")
+}
+
+// newFileUserStore opens the store, replaying its journal if journal is set.
+func newFileUserStore(filename string, journal bool) (*FileUserStore, error) {
 	store := &FileUserStore{
-		Users:    map[string]User{},
-		filename: filename,
+		Users: map[string]User{},
 	}
 
-	contents, err := ioutil.ReadFile(filename)
-	if err != nil {
-		// If it's a matter of the file not existing, that's ok
-		if os.IsNotExist(err) {
-			return store, nil
-		}
-		return nil, err
+	var apply JournalFunc
+	if journal {
+		apply = store.apply
 	}
-	err = json.Unmarshal(contents, store)
+
+	fileStore, err := NewFileStore(filename, store, apply)
 	if err != nil {
 		return nil, err
 	}
-	/*for _, usr := range store.Users {
-		globalUsernameStore = append(globalUsernameStore, usr.UserName)
-		globalUserEmailStore = append(globalUserEmailStore, usr.Email)
-	}*/
+	store.FileStore = fileStore
 	return store, nil
 }
+
+// apply replays a journal record written by Save.
+func (store *FileUserStore) apply(record JournalRecord) error {
+	switch record.Op {
+	case journalSave:
+		user := User{}
+		err := json.Unmarshal(record.Value, &user)
+		if err != nil {
+			return err
+		}
+		store.Users[record.Key] = user
+	case journalDelete:
+		delete(store.Users, record.Key)
+	default:
+		return fmt.Errorf("unknown journal operation %q", record.Op)
+	}
+	return nil
+}